@@ -2,12 +2,19 @@ package ido
 
 import (
 	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strconv"
 	"sync"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // ---------------------------------------------------------
@@ -23,7 +30,7 @@ type Unmarshaler interface {
 // CACHE
 // ---------------------------------------------------------
 
-type decoderFunc func(d []byte, v reflect.Value) error
+type decoderFunc func(s *decodeState, d []byte, v reflect.Value) error
 
 var decoderCache sync.Map // map[reflect.Type]decoderFunc
 var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
@@ -34,46 +41,135 @@ var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
 // STREAMING API (Decoder)
 // ---------------------------------------------------------
 
-// Decoder reads IDO values from an input stream.
+// Decoder reads IDO values from an input stream. Records are separated by
+// newlines, as written by Encoder; a newline inside a container is
+// whitespace, so indented records may span several lines.
 type Decoder struct {
-	r   *bufio.Reader
-	buf []byte
+	r      *bufio.Reader
+	buf    []byte
+	off    int64 // stream offset of buf[0]
+	strict bool
+	policy SchemaPolicy
+
+	schema  *Schema      // last schema header read
+	checked reflect.Type // type last checked against schema
+
+	mismatches []*FieldCountError // accepted in the last record decoded
 }
 
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{
-		r:   bufio.NewReader(r),
-		buf: make([]byte, 0, 1024),
+		r:      bufio.NewReader(r),
+		buf:    make([]byte, 0, 1024),
+		strict: true,
+		policy: DefaultSchemaPolicy,
 	}
 }
 
+// SetStrict controls whether malformed records are rejected. Strict mode is
+// on by default; turning it off restores best-effort decoding, which skips
+// the delimiter, excess field and trailing data checks.
+func (d *Decoder) SetStrict(on bool) {
+	d.strict = on
+}
+
+// SetSchemaPolicy controls which struct records written for another
+// version of the struct are accepted in strict mode. Records outside the
+// policy fail with a *FieldCountError; those it accepts are reported by
+// FieldCountMismatches. The default is DefaultSchemaPolicy.
+func (d *Decoder) SetSchemaPolicy(p SchemaPolicy) {
+	d.policy = p
+}
+
+// Decode reads the next IDO record from the stream and stores it in the
+// value pointed to by v. Error offsets are relative to the whole stream.
 func (d *Decoder) Decode(v any) error {
-	token, err := d.nextObject()
+	d.mismatches = nil
+	token, start, err := d.nextRecord()
 	if err != nil {
 		return err
 	}
-	return Unmarshal(token, v)
+	if err := d.checkSchema(v); err != nil {
+		return err
+	}
+	s := &decodeState{data: token, base: start, strict: d.strict, policy: d.policy}
+	err = unmarshal(s, v)
+	d.mismatches = s.mismatches
+	return err
+}
+
+// FieldCountMismatches reports the struct records in the last record
+// decoded that had fewer or more slots than their struct but were accepted
+// by the schema policy, in the order they were read. Got below Want means
+// fields were missing and left untouched; above means extra values were
+// ignored. It returns nil if every struct record matched its struct.
+func (d *Decoder) FieldCountMismatches() []*FieldCountError {
+	return d.mismatches
+}
+
+// Schema returns the schema header in effect for the records read so far,
+// or nil if the stream has none. Headers are read along with the record
+// that follows them.
+func (d *Decoder) Schema() *Schema {
+	return d.schema
 }
 
-func (d *Decoder) nextObject() ([]byte, error) {
+// nextRecord returns the next data record and its offset in the stream,
+// reading any schema headers before it.
+func (d *Decoder) nextRecord() ([]byte, int64, error) {
 	for {
-		advance, valid := scanObjectBoundary(d.buf)
-		if valid {
-			obj := d.buf[:advance]
+		token, start, err := d.nextObject()
+		if err != nil || len(token) == 0 || token[0] != '#' {
+			return token, start, err
+		}
+
+		var schema Schema
+		s := &decodeState{data: token[1:], base: start + 1, strict: true, policy: DefaultSchemaPolicy}
+		if err := unmarshal(s, &schema); err != nil {
+			return nil, 0, err
+		}
+		d.schema = &schema
+		d.checked = nil
+	}
+}
+
+// checkSchema checks the schema header in effect against the type v points
+// to, once per type. Generic targets are not checked.
+func (d *Decoder) checkSchema(v any) error {
+	t := reflect.TypeOf(v)
+	if d.schema == nil || t == nil || t.Kind() != reflect.Pointer || t == d.checked {
+		return nil
+	}
+	if t.Elem().Kind() == reflect.Interface {
+		return nil
+	}
+	if err := checkSchema(*d.schema, t.Elem()); err != nil {
+		return err
+	}
+	d.checked = t
+	return nil
+}
 
+// nextObject returns the next record and its offset in the stream.
+func (d *Decoder) nextObject() ([]byte, int64, error) {
+	eof := false
+	for {
+		start, end, advance, ok := scanRecord(d.buf)
+		if ok {
 			// Copy is required because Unmarshal (and custom unmarshalers)
 			// might retain the slice data.
-			result := make([]byte, advance)
-			copy(result, obj)
+			result := make([]byte, end-start)
+			copy(result, d.buf[start:end])
+			off := d.off + int64(start)
 
 			copy(d.buf, d.buf[advance:])
 			d.buf = d.buf[:len(d.buf)-advance]
+			d.off += int64(advance)
 
-			if len(result) > 0 && result[len(result)-1] == '\n' {
-				result = result[:len(result)-1]
-			}
-
-			return result, nil
+			return result, off, nil
+		}
+		if eof {
+			return nil, 0, io.ErrUnexpectedEOF
 		}
 
 		if len(d.buf) == cap(d.buf) {
@@ -87,32 +183,47 @@ func (d *Decoder) nextObject() ([]byte, error) {
 			d.buf = d.buf[:len(d.buf)+n]
 		}
 		if err != nil {
-			if err == io.EOF {
-				if len(d.buf) > 0 {
-					return nil, io.ErrUnexpectedEOF
-				}
-				return nil, io.EOF
+			if err != io.EOF {
+				return nil, 0, err
 			}
-			return nil, err
+			if len(trimSpace(d.buf)) == 0 {
+				return nil, 0, io.EOF
+			}
+			// The last record may omit its newline.
+			d.buf = append(d.buf, '\n')
+			eof = true
 		}
 	}
 }
 
-func scanObjectBoundary(data []byte) (int, bool) {
-	if len(data) == 0 {
-		return 0, false
-	}
-
-	start := 0
-	for start < len(data) && (data[start] == ' ' || data[start] == '\n' || data[start] == '\r' || data[start] == '\t') {
-		start++
-	}
-	if start == len(data) {
-		return start, false
+// scanRecord finds the first record in data. Records are newline
+// terminated: a newline outside any container ends the record, as does a
+// raw newline inside a string, which is never valid and so cannot swallow
+// the records after it. Newlines inside containers are whitespace, which
+// lets indented records span lines. Blank lines and lines holding only a
+// comment are skipped, so they never read as records.
+//
+// It returns the record as data[start:end] and the number of bytes it
+// consumes, including the newline. ok is false if data holds no complete
+// record yet.
+func scanRecord(data []byte) (start, end, advance int, ok bool) {
+	for start < len(data) {
+		switch {
+		case isSpace(data[start]):
+			start++
+			continue
+		case isComment(data, start):
+			n := bytes.IndexByte(data[start:], '\n')
+			if n < 0 {
+				return 0, 0, 0, false
+			}
+			start += n + 1
+			continue
+		}
+		break
 	}
 
 	depth := 0
-	arrDepth := 0
 	inQuote := false
 	isEscaped := false
 
@@ -120,45 +231,55 @@ func scanObjectBoundary(data []byte) (int, bool) {
 		b := data[i]
 
 		if inQuote {
-			if isEscaped {
+			switch {
+			case b == '\n':
+				return start, i, i + 1, true
+			case isEscaped:
 				isEscaped = false
-			} else if b == '\\' {
+			case b == '\\':
 				isEscaped = true
-			} else if b == '"' {
+			case b == '"':
 				inQuote = false
 			}
 			continue
 		}
 
 		switch b {
-		case '{':
+		case '{', '[', '<':
 			depth++
-		case '}':
+		case '}', ']', '>':
 			depth--
-		case '[':
-			arrDepth++
-		case ']':
-			arrDepth--
 		case '"':
 			inQuote = true
-		}
-
-		if depth == 0 && arrDepth == 0 {
-			return i + 1, true
+		case '/':
+			if isComment(data, i) {
+				i = commentEnd(data, i) - 1
+			}
+		case '\n':
+			if depth <= 0 {
+				return start, i, i + 1, true
+			}
 		}
 	}
 
-	return 0, false
+	return 0, 0, 0, false
 }
 
 // ---------------------------------------------------------
 // STANDARD API (Unmarshal)
 // ---------------------------------------------------------
 
-func Unmarshal(data []byte, s any) error {
-	rv := reflect.ValueOf(s)
+// Unmarshal decodes data into the value pointed to by v. Malformed input is
+// reported as a *SyntaxError and values that do not fit their Go type as an
+// *UnmarshalTypeError. Unmarshal always decodes in strict mode.
+func Unmarshal(data []byte, v any) error {
+	return unmarshal(&decodeState{data: data, strict: true, policy: DefaultSchemaPolicy}, v)
+}
+
+func unmarshal(s *decodeState, v any) error {
+	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Pointer || rv.IsNil() {
-		return fmt.Errorf("ido: Unmarshal(non-pointer %v)", reflect.TypeOf(s))
+		return fmt.Errorf("ido: Unmarshal(non-pointer %v)", reflect.TypeOf(v))
 	}
 
 	val := rv.Elem()
@@ -167,7 +288,23 @@ func Unmarshal(data []byte, s any) error {
 		return err
 	}
 
-	return decoder(data, val)
+	if s.strict {
+		if err := checkStructure(s, s.data); err != nil {
+			return err
+		}
+	}
+
+	// An empty record is an empty slot, as written for a zero scalar or
+	// nil, and leaves v untouched just like one inside a container.
+	data := trimSpace(s.data)
+	if len(data) == 0 {
+		return nil
+	}
+	if isNull(data) {
+		val.SetZero()
+		return nil
+	}
+	return decoder(s, data, val)
 }
 
 // ---------------------------------------------------------
@@ -189,7 +326,7 @@ func getDecoder(t reflect.Type) (decoderFunc, error) {
 func compileDecoder(t reflect.Type) (decoderFunc, error) {
 	// 1. Check if type T implements Unmarshaler
 	if t.Implements(unmarshalerType) {
-		return func(d []byte, v reflect.Value) error {
+		return func(s *decodeState, d []byte, v reflect.Value) error {
 			if v.Kind() == reflect.Pointer && v.IsNil() {
 				v.Set(reflect.New(v.Type().Elem()))
 			}
@@ -199,7 +336,7 @@ func compileDecoder(t reflect.Type) (decoderFunc, error) {
 
 	// 2. Check if *T implements Unmarshaler (when we have T)
 	if t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(unmarshalerType) {
-		return func(d []byte, v reflect.Value) error {
+		return func(s *decodeState, d []byte, v reflect.Value) error {
 			if !v.CanAddr() {
 				return fmt.Errorf("ido: cannot unmarshal into unaddressable value")
 			}
@@ -207,20 +344,42 @@ func compileDecoder(t reflect.Type) (decoderFunc, error) {
 		}, nil
 	}
 
-	// 3. Standard types
+	// 3. Fall back to encoding.TextUnmarshaler, unless the type only has
+	// the encoding half of Marshaler and Unmarshaler.
+	if isTextType(t, textUnmarshalerType) && !customEncoding(t) {
+		return decodeText, nil
+	}
+
+	// 4. Standard types
 	switch t.Kind() {
 	case reflect.String:
+		if t == numberType {
+			return decodeNumber, nil
+		}
 		return decodeString, nil
 	case reflect.Bool:
 		return decodeBool, nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t == durationType {
+			return decodeDuration, nil
+		}
 		return decodeInt, nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		return decodeUint, nil
 	case reflect.Float32, reflect.Float64:
 		return decodeFloat, nil
 	case reflect.Slice:
+		if isByteSeq(t) {
+			return compileBytesDecoder(t, compileSliceDecoder)
+		}
 		return compileSliceDecoder(t)
+	case reflect.Array:
+		if isByteSeq(t) {
+			return compileBytesDecoder(t, compileArrayDecoder)
+		}
+		return compileArrayDecoder(t)
+	case reflect.Map:
+		return compileMapDecoder(t)
 	case reflect.Struct:
 		if t == timeType {
 			return decodeTime, nil
@@ -231,17 +390,21 @@ func compileDecoder(t reflect.Type) (decoderFunc, error) {
 		if err != nil {
 			return nil, err
 		}
-		return func(d []byte, v reflect.Value) error {
+		return func(s *decodeState, d []byte, v reflect.Value) error {
 			if len(d) == 0 {
 				return nil
 			}
+			if isNull(d) {
+				v.SetZero()
+				return nil
+			}
 			if v.IsNil() {
 				v.Set(reflect.New(t.Elem()))
 			}
-			return elemDec(d, v.Elem())
+			return elemDec(s, d, v.Elem())
 		}, nil
 	case reflect.Interface:
-		return func(d []byte, v reflect.Value) error { return nil }, nil
+		return compileInterfaceDecoder(t), nil
 	default:
 		return nil, fmt.Errorf("unsupported type for decoding: %s", t)
 	}
@@ -249,99 +412,575 @@ func compileDecoder(t reflect.Type) (decoderFunc, error) {
 
 func compileStructDecoder(t reflect.Type) (decoderFunc, error) {
 	type fieldInfo struct {
-		idx     int
-		decoder decoderFunc
+		index   []int
+		name    string
+		decoder decoderFunc // nil for a hole
 	}
-	var fields []fieldInfo
 
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		if f.Tag.Get("ido") == "-" {
+	slots, err := structFields(t)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]fieldInfo, len(slots))
+	for i, f := range slots {
+		if f.index == nil {
 			continue
 		}
-		dec, err := compileDecoder(f.Type)
-		if err != nil {
-			return nil, err
+		dec := decodeJSON
+		if !f.json {
+			var err error
+			if dec, err = compileDecoder(t.FieldByIndex(f.index).Type); err != nil {
+				return nil, err
+			}
 		}
-		fields = append(fields, fieldInfo{idx: i, decoder: dec})
+		fields[i] = fieldInfo{index: f.index, name: f.name, decoder: dec}
 	}
 
-	return func(data []byte, v reflect.Value) error {
-		if len(data) < 2 {
-			return nil
-		}
-		content := data[1 : len(data)-1]
-		if len(content) == 0 {
-			return nil
+	return func(s *decodeState, data []byte, v reflect.Value) error {
+		content, err := s.containerContent(data, '{', t)
+		if err != nil {
+			return err
 		}
 
-		for _, field := range fields {
-			if len(content) == 0 {
+		got := 0 // slots in the record; {} is one empty slot
+		more := true
+		for i, field := range fields {
+			if !more {
 				break
 			}
 
-			token, advance := nextToken(content)
+			var token []byte
+			token, content, more = nextToken(content)
+			got++
 
-			if len(token) > 0 {
-				if err := field.decoder(token, v.Field(field.idx)); err != nil {
-					return err
+			if field.decoder == nil {
+				if s.strict && len(token) > 0 && !slots[i].deprecated {
+					return s.typeError(token, t)
+				}
+			} else if isNull(token) {
+				if fv, ok := fieldByIndex(v, field.index, false); ok {
+					fv.SetZero()
+				}
+			} else if len(token) > 0 {
+				fv, _ := fieldByIndex(v, field.index, true)
+				n := len(s.mismatches)
+				if err := field.decoder(s, token, fv); err != nil {
+					return addFieldPath(err, field.name)
 				}
+				s.addMismatchPath(n, field.name)
 			}
+		}
 
-			if advance >= len(content) {
-				content = nil
-			} else {
-				content = content[advance:]
+		// Empty trailing slots carry no value and are not extras.
+		for n := got; more; {
+			var token []byte
+			token, content, more = nextToken(content)
+			if n++; len(token) > 0 {
+				got = n
 			}
 		}
+		if got == len(fields) {
+			return nil
+		}
+
+		fcErr := s.fieldCountError(data, t, got, len(fields))
+		if s.strict && (got < len(fields) && s.policy&AllowMissingFields == 0 ||
+			got > len(fields) && s.policy&AllowExtraFields == 0) {
+			return fcErr
+		}
+		s.mismatches = append(s.mismatches, fcErr)
 		return nil
 	}, nil
 }
 
+// compileInterfaceDecoder rebuilds the concrete value of an @name:value
+// token from the type registry. Empty interfaces also accept untagged
+// values, which decode into a generic tree (see decodeAny).
+func compileInterfaceDecoder(t reflect.Type) decoderFunc {
+	if t.NumMethod() == 0 {
+		return decodeAnyValue
+	}
+	return func(s *decodeState, d []byte, v reflect.Value) error {
+		if len(d) == 0 || d[0] != '@' {
+			return s.typeError(d, t)
+		}
+
+		name, value, ok := splitTypeTag(d)
+		if !ok {
+			return s.syntaxError(d, "malformed type tag", "@name:")
+		}
+		rt, ok := registeredType(unsafeString(name))
+		if !ok || !rt.Implements(t) {
+			return s.typeError(d, t)
+		}
+
+		elem, err := decodeRegistered(s, rt, value)
+		if err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+}
+
+// decodeRegistered decodes value into a new value of the registered type rt.
+func decodeRegistered(s *decodeState, rt reflect.Type, value []byte) (reflect.Value, error) {
+	dec, err := getDecoder(rt)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	elem := reflect.New(rt).Elem()
+	if len(value) > 0 {
+		if err := dec(s, value, elem); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	return elem, nil
+}
+
+// splitTypeTag splits @name:value into its name and value.
+func splitTypeTag(data []byte) (name, value []byte, ok bool) {
+	for i := 1; i < len(data); i++ {
+		if data[i] == ':' {
+			return data[1:i], trimSpace(data[i+1:]), i > 1
+		}
+		if !isTypeNameByte(data[i]) {
+			break
+		}
+	}
+	return nil, nil, false
+}
+
 func compileSliceDecoder(t reflect.Type) (decoderFunc, error) {
 	elemDec, err := compileDecoder(t.Elem())
 	if err != nil {
 		return nil, err
 	}
 
-	return func(data []byte, v reflect.Value) error {
-		if len(data) < 2 {
-			return nil
-		}
-		content := data[1 : len(data)-1]
-		if len(content) == 0 {
-			return nil
+	return func(s *decodeState, data []byte, v reflect.Value) error {
+		content, err := s.containerContent(data, '[', t)
+		if err != nil {
+			return err
 		}
 
-		v.SetLen(0)
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(t, 0, 0))
+		} else {
+			v.SetLen(0)
+		}
 
-		for len(content) > 0 {
-			token, advance := nextToken(content)
+		for more := len(content) > 0; more; {
+			var token []byte
+			token, content, more = nextToken(content)
 
 			newElem := reflect.New(t.Elem()).Elem()
-			if len(token) > 0 {
-				if err := elemDec(token, newElem); err != nil {
-					return err
+			if len(token) > 0 && !isNull(token) {
+				n := len(s.mismatches)
+				if err := elemDec(s, token, newElem); err != nil {
+					return addFieldPath(err, "["+strconv.Itoa(v.Len())+"]")
+				}
+				if len(s.mismatches) > n {
+					s.addMismatchPath(n, "["+strconv.Itoa(v.Len())+"]")
 				}
 			}
 			v.Set(reflect.Append(v, newElem))
+		}
+		return nil
+	}, nil
+}
 
-			if advance >= len(content) {
-				break
+// compileArrayDecoder fills a fixed-size array from [...] input. Elements
+// missing from the input are zeroed; surplus elements are an error.
+func compileArrayDecoder(t reflect.Type) (decoderFunc, error) {
+	elemDec, err := compileDecoder(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	n := t.Len()
+
+	return func(s *decodeState, data []byte, v reflect.Value) error {
+		content, err := s.containerContent(data, '[', t)
+		if err != nil {
+			return err
+		}
+
+		i := 0
+		for more := len(content) > 0; more; i++ {
+			var token []byte
+			token, content, more = nextToken(content)
+			if i == n {
+				return s.typeError(token, t)
 			}
-			content = content[advance:]
+
+			elem := v.Index(i)
+			elem.SetZero()
+			if len(token) > 0 && !isNull(token) {
+				n := len(s.mismatches)
+				if err := elemDec(s, token, elem); err != nil {
+					return addFieldPath(err, "["+strconv.Itoa(i)+"]")
+				}
+				if len(s.mismatches) > n {
+					s.addMismatchPath(n, "["+strconv.Itoa(i)+"]")
+				}
+			}
+		}
+
+		for ; i < n; i++ {
+			v.Index(i).SetZero()
 		}
 		return nil
 	}, nil
 }
 
-func nextToken(data []byte) (token []byte, advance int) {
+// compileBytesDecoder decodes b"base64" into a byte slice or array. Input
+// in the element-wise [1,2,3] form of older versions goes to the decoder
+// compiled by legacy.
+func compileBytesDecoder(t reflect.Type, legacy func(reflect.Type) (decoderFunc, error)) (decoderFunc, error) {
+	legacyDec, err := legacy(t)
+	if err != nil {
+		return nil, err
+	}
+	isSlice := t.Kind() == reflect.Slice
+
+	return func(s *decodeState, data []byte, v reflect.Value) error {
+		if len(data) == 0 || data[0] != 'b' {
+			return legacyDec(s, data, v)
+		}
+		b, err := decodeBase64(s, data)
+		if err != nil {
+			return err
+		}
+		if isSlice {
+			v.SetBytes(b)
+			return nil
+		}
+		if len(b) > v.Len() {
+			return s.typeError(data, t)
+		}
+		// Decode targets are addressable, so Bytes works here, also for
+		// named byte element types that reflect.Copy from a []byte rejects.
+		dst := v.Bytes()
+		n := copy(dst, b)
+		clear(dst[n:])
+		return nil
+	}, nil
+}
+
+// decodeBase64 decodes a b"base64" token.
+func decodeBase64(s *decodeState, d []byte) ([]byte, error) {
+	if len(d) < 3 || d[1] != '"' || d[len(d)-1] != '"' {
+		return nil, s.syntaxError(d, "malformed byte string", `b"`)
+	}
+	src := d[2 : len(d)-1]
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(src)))
+	n, err := base64.StdEncoding.Decode(b, src)
+	if err != nil {
+		return nil, s.syntaxError(src, "invalid base64 data", "base64")
+	}
+	return b[:n], nil
+}
+
+func compileMapDecoder(t reflect.Type) (decoderFunc, error) {
+	if !isMapKeyKind(t.Key().Kind()) {
+		return nil, fmt.Errorf("unsupported map key type for decoding: %s", t.Key())
+	}
+	keyDec, err := compileDecoder(t.Key())
+	if err != nil {
+		return nil, err
+	}
+	elemDec, err := compileDecoder(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	return func(s *decodeState, data []byte, v reflect.Value) error {
+		content, err := s.containerContent(data, '<', t)
+		if err != nil {
+			return err
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		} else {
+			v.Clear()
+		}
+
+		for more := len(content) > 0; more; {
+			var token []byte
+			token, content, more = nextToken(content)
+
+			if len(token) > 0 {
+				keyToken, valToken, ok := splitMapEntry(token)
+				if !ok {
+					return s.syntaxError(token, "map entry without key", ":")
+				}
+				if len(keyToken) == 0 {
+					return s.syntaxError(token, "invalid map key", "string or number")
+				}
+
+				key := reflect.New(t.Key()).Elem()
+				if err := keyDec(s, keyToken, key); err != nil {
+					return err
+				}
+				val := reflect.New(t.Elem()).Elem()
+				if len(valToken) > 0 && !isNull(valToken) {
+					n := len(s.mismatches)
+					if err := elemDec(s, valToken, val); err != nil {
+						return addFieldPath(err, "["+string(keyToken)+"]")
+					}
+					if len(s.mismatches) > n {
+						s.addMismatchPath(n, "["+string(keyToken)+"]")
+					}
+				}
+				v.SetMapIndex(key, val)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// splitMapEntry splits a key:value entry at the first ':' outside quotes.
+// Keys are always scalars, so that colon is the separator.
+func splitMapEntry(data []byte) (key, val []byte, ok bool) {
+	inQuote := false
+	isEscaped := false
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if inQuote {
+			if isEscaped {
+				isEscaped = false
+			} else if b == '\\' {
+				isEscaped = true
+			} else if b == '"' {
+				inQuote = false
+			}
+			continue
+		}
+
+		switch b {
+		case '"':
+			inQuote = true
+		case '/':
+			if isComment(data, i) {
+				i = commentEnd(data, i) - 1
+			}
+		case ':':
+			return trimSpace(data[:i]), trimSpace(data[i+1:]), true
+		}
+	}
+	return nil, nil, false
+}
+
+// containerContent strips the delimiters from a container token. In strict
+// mode a token that is not enclosed in open and its closing byte is an
+// error; otherwise the outer bytes are dropped unchecked.
+func (s *decodeState) containerContent(data []byte, open byte, t reflect.Type) ([]byte, error) {
+	if len(data) >= 2 && data[0] == open && data[len(data)-1] == closing(open) {
+		return trimSpace(data[1 : len(data)-1]), nil
+	}
+	if s.strict {
+		return nil, s.mismatch(data, t, string(open))
+	}
+	if len(data) < 2 {
+		return nil, nil
+	}
+	return trimSpace(data[1 : len(data)-1]), nil
+}
+
+// checkStructure verifies that every bracket in data is closed by its
+// matching bracket, that every string is terminated on the line it starts
+// on, and that a closed string or container is followed only by a
+// separator or a closing bracket. Once the top-level value is closed only
+// whitespace may follow. Containers may nest at most maxDepth deep.
+func checkStructure(s *decodeState, data []byte) error {
+	var stack []byte
+	inQuote := false
+	isEscaped := false
+	closed := false
+	quoteStart := 0
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+
+		if inQuote {
+			if b == '\n' {
+				break // strings never span lines
+			}
+			if isEscaped {
+				isEscaped = false
+			} else if b == '\\' {
+				isEscaped = true
+			} else if b == '"' {
+				inQuote = false
+				closed = true
+			}
+			continue
+		}
+
+		if isComment(data, i) {
+			i = commentEnd(data, i) - 1
+			continue
+		}
+
+		if closed {
+			if isSpace(b) {
+				continue
+			}
+			closed = false
+			if len(stack) == 0 {
+				if rest := trimSpace(data[i:]); len(rest) > 0 {
+					return s.syntaxError(rest, "trailing data after top-level value", "end of input")
+				}
+				return nil
+			}
+			switch b {
+			case ',', ':', '}', ']', '>':
+			default:
+				return s.syntaxError(data[i:], "unexpected "+strconv.QuoteRune(rune(b))+" after value", ",")
+			}
+		}
+
+		switch b {
+		case '{', '[', '<':
+			if len(stack) == maxDepth {
+				return s.syntaxError(data[i:], "exceeded max nesting depth", "")
+			}
+			stack = append(stack, closing(b))
+		case '}', ']', '>':
+			if len(stack) == 0 {
+				return s.syntaxError(data[i:], "unexpected "+strconv.QuoteRune(rune(b)), "value")
+			}
+			if want := stack[len(stack)-1]; want != b {
+				return s.syntaxError(data[i:], "unexpected "+strconv.QuoteRune(rune(b)), string(want))
+			}
+			stack = stack[:len(stack)-1]
+			closed = true
+		case '"':
+			inQuote = true
+			quoteStart = i
+		}
+	}
+
+	if inQuote {
+		return s.syntaxError(data[quoteStart:], "unterminated string", `"`)
+	}
+	if len(stack) > 0 {
+		return s.syntaxError(data[len(data):], "unexpected end of input", string(stack[len(stack)-1]))
+	}
+	return nil
+}
+
+// isNull reports whether d is the null marker '~', which sets a value to
+// its zero value (nil for pointers, slices, maps and interfaces).
+func isNull(d []byte) bool {
+	return len(d) == 1 && d[0] == '~'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t'
+}
+
+// trimSpace removes the insignificant whitespace and comments around a
+// token.
+func trimSpace(b []byte) []byte {
+	b = b[skipSpace(b):]
+	for len(b) > 0 && isSpace(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	if bytes.IndexByte(b, '/') < 0 {
+		return b
+	}
+
+	// A trailing comment can only be told apart from a '/' inside a string
+	// by scanning forward.
+	end := 0
+	for i := 0; i < len(b); i++ {
+		switch {
+		case b[i] == '"':
+			i += stringEnd(b[i:]) - 1
+			end = i + 1
+		case isComment(b, i):
+			i = commentEnd(b, i) - 1
+		case !isSpace(b[i]):
+			end = i + 1
+		}
+	}
+	return b[:end]
+}
+
+// skipSpace returns the length of the whitespace and comments at the start
+// of data.
+func skipSpace(data []byte) int {
+	i := 0
+	for i < len(data) {
+		if isSpace(data[i]) {
+			i++
+		} else if isComment(data, i) {
+			i = commentEnd(data, i)
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+// isComment reports whether a // comment starts at data[i].
+func isComment(data []byte, i int) bool {
+	return data[i] == '/' && i+1 < len(data) && data[i+1] == '/'
+}
+
+// commentEnd returns the index of the newline ending the comment that
+// starts at data[i], or len(data) if the comment runs to the end.
+func commentEnd(data []byte, i int) int {
+	if n := bytes.IndexByte(data[i:], '\n'); n >= 0 {
+		return i + n
+	}
+	return len(data)
+}
+
+// stringEnd returns the index just past the closing quote of the string
+// starting at data[0]. An unterminated string runs to the first raw
+// newline, or to len(data).
+func stringEnd(data []byte) int {
+	for i := 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return len(data)
+}
+
+// closing returns the delimiter that closes the container opened by open.
+func closing(open byte) byte {
+	switch open {
+	case '{':
+		return '}'
+	case '[':
+		return ']'
+	case '<':
+		return '>'
+	}
+	return 0
+}
+
+// nextToken splits the first comma-separated token off data. more reports
+// whether a separator followed it, so a trailing comma still yields a final
+// empty token.
+func nextToken(data []byte) (token, rest []byte, more bool) {
 	depth := 0
 	arrDepth := 0
+	mapDepth := 0
 	inQuote := false
 	isEscaped := false
 
-	for i, b := range data {
+	for i := 0; i < len(data); i++ {
+		b := data[i]
 		if inQuote {
 			if isEscaped {
 				isEscaped = false
@@ -362,106 +1001,286 @@ func nextToken(data []byte) (token []byte, advance int) {
 			arrDepth++
 		case ']':
 			arrDepth--
+		case '<':
+			mapDepth++
+		case '>':
+			mapDepth--
 		case '"':
 			inQuote = true
+		case '/':
+			if isComment(data, i) {
+				i = commentEnd(data, i) - 1
+			}
 		case ',':
-			if depth == 0 && arrDepth == 0 {
-				return data[:i], i + 1
+			if depth == 0 && arrDepth == 0 && mapDepth == 0 {
+				return trimSpace(data[:i]), data[i+1:], true
 			}
 		}
 	}
-	return data, len(data)
+	return trimSpace(data), nil, false
 }
 
 // ---------------------------------------------------------
 // PRIMITIVES (Decoder)
 // ---------------------------------------------------------
 
-func decodeString(d []byte, v reflect.Value) error {
+func decodeString(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) >= 2 && d[0] == '"' && d[len(d)-1] == '"' {
-		v.SetString(unescape(d[1 : len(d)-1]))
+		str, err := unescape(s, d[1:len(d)-1])
+		if err != nil {
+			return err
+		}
+		v.SetString(str)
+	} else if s.strict {
+		return s.mismatch(d, v.Type(), `"`)
 	} else {
 		v.SetString(unsafeString(d))
 	}
 	return nil
 }
 
-func decodeBool(d []byte, v reflect.Value) error {
+// decodeNumber stores a number literal in a Number as written.
+func decodeNumber(s *decodeState, d []byte, v reflect.Value) error {
+	if len(d) == 0 {
+		return nil
+	}
+	if !isNumber(d) && !isNonFinite(d) {
+		return s.mismatch(d, v.Type(), "number")
+	}
+	v.SetString(string(d))
+	return nil
+}
+
+// decodeText passes the contents of a string to UnmarshalText of *T.
+func decodeText(s *decodeState, d []byte, v reflect.Value) error {
+	if len(d) < 2 || d[0] != '"' || d[len(d)-1] != '"' {
+		return s.mismatch(d, v.Type(), `"`)
+	}
+	if !v.CanAddr() {
+		return fmt.Errorf("ido: cannot unmarshal into unaddressable value")
+	}
+	text, err := unescape(s, d[1:len(d)-1])
+	if err != nil {
+		return err
+	}
+	return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+}
+
+// decodeJSON feeds the contents of a string to json.Unmarshal, for fields
+// tagged ido:",json".
+func decodeJSON(s *decodeState, d []byte, v reflect.Value) error {
+	if len(d) < 2 || d[0] != '"' || d[len(d)-1] != '"' {
+		return s.mismatch(d, v.Type(), `"`)
+	}
+	text, err := unescape(s, d[1:len(d)-1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(text), v.Addr().Interface())
+}
+
+func decodeBool(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) == 1 && d[0] == '+' {
 		v.SetBool(true)
+	} else if s.strict && len(d) > 0 && !(len(d) == 1 && d[0] == '-') {
+		return s.mismatch(d, v.Type(), "+")
 	} else {
 		v.SetBool(false)
 	}
 	return nil
 }
 
-func decodeInt(d []byte, v reflect.Value) error {
+func decodeInt(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) == 0 {
 		return nil
 	}
+	// ParseInt also takes a leading '+', which is not part of an IDO number.
+	if s.strict && !isNumber(d) {
+		return s.mismatch(d, v.Type(), "number")
+	}
 	n, err := strconv.ParseInt(unsafeString(d), 10, 64)
 	if err != nil {
-		return err
+		return s.mismatch(d, v.Type(), "number")
+	}
+	if v.OverflowInt(n) {
+		return s.typeError(d, v.Type())
 	}
 	v.SetInt(n)
 	return nil
 }
 
-func decodeUint(d []byte, v reflect.Value) error {
+func decodeUint(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) == 0 {
 		return nil
 	}
+	// Strict mode takes only IDO number literals, as in decodeInt.
+	if s.strict && !isNumber(d) {
+		return s.mismatch(d, v.Type(), "number")
+	}
 	n, err := strconv.ParseUint(unsafeString(d), 10, 64)
 	if err != nil {
-		return err
+		return s.mismatch(d, v.Type(), "number")
+	}
+	if v.OverflowUint(n) {
+		return s.typeError(d, v.Type())
 	}
 	v.SetUint(n)
 	return nil
 }
 
-func decodeFloat(d []byte, v reflect.Value) error {
+func decodeFloat(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) == 0 {
 		return nil
 	}
+	// ParseFloat also takes forms such as "nan", "+Inf" and hex floats,
+	// which are not IDO numbers.
+	if s.strict && !isNumber(d) && !isNonFinite(d) {
+		return s.mismatch(d, v.Type(), "number")
+	}
 	n, err := strconv.ParseFloat(unsafeString(d), 64)
 	if err != nil {
-		return err
+		return s.mismatch(d, v.Type(), "number")
+	}
+	if v.Kind() == reflect.Float32 {
+		// Out of float32 range is always an error. In strict mode so is a
+		// value float32 cannot hold: the shortest float32 form must read
+		// back as the same number.
+		n32, err := strconv.ParseFloat(unsafeString(d), 32)
+		if err != nil {
+			return s.typeError(d, v.Type())
+		}
+		if s.strict && n32 != n && !math.IsNaN(n) {
+			if x, _ := strconv.ParseFloat(strconv.FormatFloat(n32, 'g', -1, 32), 64); x != n {
+				return s.typeError(d, v.Type())
+			}
+		}
 	}
 	v.SetFloat(n)
 	return nil
 }
 
-func decodeTime(d []byte, v reflect.Value) error {
+// decodeTime reads either TimeFormat: an RFC 3339 string, keeping its
+// nanoseconds and zone offset, or integer Unix microseconds, in UTC.
+func decodeTime(s *decodeState, d []byte, v reflect.Value) error {
 	if len(d) == 0 {
 		return nil
 	}
+	if d[0] == '"' {
+		if len(d) < 2 || d[len(d)-1] != '"' {
+			return s.syntaxError(d, "unterminated string", `"`)
+		}
+		t, err := time.Parse(time.RFC3339Nano, unsafeString(d[1:len(d)-1]))
+		if err != nil {
+			return s.typeError(d, v.Type())
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
 	n, err := strconv.ParseInt(unsafeString(d), 10, 64)
 	if err != nil {
-		return nil
+		return s.mismatch(d, v.Type(), "number or RFC 3339 string")
 	}
 	v.Set(reflect.ValueOf(time.UnixMicro(n).UTC()))
 	return nil
 }
 
-func unescape(b []byte) string {
-	hasEscape := false
-	for _, c := range b {
-		if c == '\\' {
-			hasEscape = true
-			break
-		}
+// decodeDuration reads a time.Duration written as a duration string, or as
+// integer nanoseconds by older versions.
+func decodeDuration(s *decodeState, d []byte, v reflect.Value) error {
+	if len(d) == 0 || d[0] != '"' {
+		return decodeInt(s, d, v)
 	}
-	if !hasEscape {
-		return string(b)
+	if len(d) < 2 || d[len(d)-1] != '"' {
+		return s.syntaxError(d, "unterminated string", `"`)
+	}
+	n, err := time.ParseDuration(unsafeString(d[1 : len(d)-1]))
+	if err != nil {
+		return s.typeError(d, v.Type())
+	}
+	v.SetInt(int64(n))
+	return nil
+}
+
+// unescape decodes the contents of a quoted string, b being the bytes
+// between the quotes. Invalid escape sequences are reported as a
+// *SyntaxError at their offset.
+func unescape(s *decodeState, b []byte) (string, error) {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b), nil
 	}
 	out := make([]byte, 0, len(b))
 	for i := 0; i < len(b); i++ {
-		if b[i] == '\\' && i+1 < len(b) && b[i+1] == '"' {
-			out = append(out, '"')
-			i++
-		} else {
+		if b[i] != '\\' {
 			out = append(out, b[i])
+			continue
+		}
+		n := escapeLen(b[i:])
+		if n == 0 {
+			return "", s.syntaxError(b[i:], "invalid escape sequence", escapeSequences)
+		}
+		switch c := b[i+1]; c {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r := rune(hexValue(b[i+2 : i+6]))
+			if n == 12 {
+				r = utf16.DecodeRune(r, rune(hexValue(b[i+8:i+12])))
+			}
+			out = utf8.AppendRune(out, r)
+		default:
+			out = append(out, c)
+		}
+		i += n - 1
+	}
+	return string(out), nil
+}
+
+// escapeSequences lists the escapes accepted inside strings, for errors.
+const escapeSequences = `\", \\, \n, \r, \t or \uXXXX`
+
+// escapeLen returns the length of the escape sequence at the start of b,
+// which begins with a backslash, or 0 if it is not a valid one. A \uXXXX
+// high surrogate followed by a low surrogate is one 12-byte sequence.
+func escapeLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[1] {
+	case '"', '\\', 'n', 'r', 't':
+		return 2
+	case 'u':
+		if len(b) < 6 || hexValue(b[2:6]) < 0 {
+			return 0
+		}
+		if r := rune(hexValue(b[2:6])); utf16.IsSurrogate(r) && len(b) >= 12 && b[6] == '\\' && b[7] == 'u' {
+			if r2 := rune(hexValue(b[8:12])); r2 >= 0 && utf16.DecodeRune(r, r2) != utf8.RuneError {
+				return 12
+			}
+		}
+		return 6
+	}
+	return 0
+}
+
+// hexValue parses four hex digits, returning -1 if b holds anything else.
+func hexValue(b []byte) int {
+	n := 0
+	for _, c := range b {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return -1
 		}
+		n = n<<4 | int(c)
 	}
-	return string(out)
+	return n
 }
@@ -0,0 +1,591 @@
+package ido
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestStrictIntegerSign(t *testing.T) {
+	var v struct {
+		I int
+		U uint
+	}
+	for _, in := range []string{"{+5,1}", "{1,+5}"} {
+		dec := NewDecoder(bytes.NewReader([]byte(in + "\n")))
+		if err := dec.Decode(&v); err == nil {
+			t.Errorf("strict Decode(%s) = %+v, want error", in, v)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader([]byte("{+5,1}\n")))
+	dec.SetStrict(false)
+	if err := dec.Decode(&v); err != nil || v.I != 5 {
+		t.Errorf("non-strict Decode({+5,1}) = %+v, %v; want I 5", v, err)
+	}
+}
+
+func TestDecoderSkipsBlankLines(t *testing.T) {
+	type pair struct{ A, B int }
+	in := "{1,2}\n\n{3,4}\n \t\r\n// note\n\n"
+	dec := NewDecoder(strings.NewReader(in))
+	var got []pair
+	for {
+		var p pair
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		got = append(got, p)
+	}
+	if want := []pair{{1, 2}, {3, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	type pair struct{ A, B int }
+	num := 0
+	values := []any{
+		nil,
+		false,
+		true,
+		0,
+		"",
+		"two\nlines",
+		Number(""),
+		[]int(nil),
+		map[string]int(nil),
+		(*int)(nil),
+		&num,
+		pair{},
+		pair{1, 2},
+		[]string{"a", "b"},
+	}
+	wants := []any{
+		nil,
+		false,
+		true,
+		0,
+		"",
+		"two\nlines",
+		Number("0"),
+		[]int{},
+		map[string]int(nil),
+		(*int)(nil),
+		&num,
+		pair{},
+		pair{1, 2},
+		[]string{"a", "b"},
+	}
+
+	for _, indent := range []string{"", "  "} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetIndent("", indent)
+		for _, v := range values {
+			if err := enc.Encode(v); err != nil {
+				t.Fatalf("Encode(%#v): %v", v, err)
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				t.Errorf("indent %q: stream has a blank line:\n%s", indent, buf.String())
+				break
+			}
+		}
+
+		dec := NewDecoder(&buf)
+		for i, want := range wants {
+			target := reflect.New(reflect.TypeOf(&want).Elem())
+			if want != nil {
+				target = reflect.New(reflect.TypeOf(want))
+			}
+			if err := dec.Decode(target.Interface()); err != nil {
+				t.Fatalf("indent %q: Decode record %d: %v", indent, i, err)
+			}
+			if got := target.Elem().Interface(); !reflect.DeepEqual(got, want) {
+				t.Errorf("indent %q: record %d = %#v, want %#v", indent, i, got, want)
+			}
+		}
+		var extra any
+		if err := dec.Decode(&extra); err != io.EOF {
+			t.Errorf("indent %q: Decode after last record = %v, want io.EOF", indent, err)
+		}
+	}
+}
+
+func TestDecoderFraming(t *testing.T) {
+	// A raw newline inside a string ends the record, so the broken record
+	// fails on its own and the next one still decodes.
+	dec := NewDecoder(strings.NewReader("\"open\n\"ok\"\n[1,\n 2]"))
+	var s string
+	var serr *SyntaxError
+	if err := dec.Decode(&s); !errors.As(err, &serr) || serr.Offset != 0 {
+		t.Errorf("Decode(unterminated) = %v, want *SyntaxError at offset 0", err)
+	}
+	if err := dec.Decode(&s); err != nil || s != "ok" {
+		t.Errorf("Decode = %q, %v; want \"ok\"", s, err)
+	}
+	var list []int
+	if err := dec.Decode(&list); err != nil || !reflect.DeepEqual(list, []int{1, 2}) {
+		t.Errorf("Decode(last record without newline) = %v, %v; want [1 2]", list, err)
+	}
+	if err := dec.Decode(&list); err != io.EOF {
+		t.Errorf("Decode at end = %v, want io.EOF", err)
+	}
+}
+
+func TestStrictSyntaxErrors(t *testing.T) {
+	type record struct {
+		A int
+		B []int
+		C string
+	}
+	for _, tt := range []struct {
+		in     string
+		offset int64
+	}{
+		{`{1,[2},"x"}`, 5},     // wrong closing delimiter
+		{`{1,[2],"x"]`, 10},    // wrong closing delimiter
+		{`{1,[2],"x"} 5`, 12},  // trailing data
+		{`{1,[2],"x"}}`, 11},   // trailing data
+		{`{1,[2],"x`, 7},       // unterminated string
+		{"{1,[2],\"x\n\"}", 7}, // strings never span lines
+		{`{1,[2],"x"`, 10},     // unclosed struct
+		{`{1,[2],x}`, 7},       // bare word for a string
+		{`{1,[2]"x"}`, 6},      // missing separator
+		{`{1,[2],"x"y}`, 10},   // data after a string
+	} {
+		var v record
+		var serr *SyntaxError
+		if err := Unmarshal([]byte(tt.in), &v); !errors.As(err, &serr) || serr.Offset != tt.offset {
+			t.Errorf("Unmarshal(%q) = %v, want *SyntaxError at offset %d", tt.in, err, tt.offset)
+		}
+	}
+}
+
+func TestStrictTypeErrors(t *testing.T) {
+	var b bool
+	var terr *UnmarshalTypeError
+	if err := Unmarshal([]byte(`"+"`), &b); !errors.As(err, &terr) {
+		t.Errorf("Unmarshal(\"+\") into bool = %v, want *UnmarshalTypeError", err)
+	}
+	var serr *SyntaxError
+	if err := Unmarshal([]byte(`yes`), &b); !errors.As(err, &serr) || serr.Offset != 0 {
+		t.Errorf("Unmarshal(yes) into bool = %v, want *SyntaxError at offset 0", err)
+	}
+	var s struct{ A, B int }
+	if err := Unmarshal([]byte(`[1,2]`), &s); !errors.As(err, &terr) {
+		t.Errorf("Unmarshal([1,2]) into struct = %v, want *UnmarshalTypeError", err)
+	}
+	var fcerr *FieldCountError
+	if err := Unmarshal([]byte(`{1,2,3}`), &s); !errors.As(err, &fcerr) || fcerr.Got != 3 || fcerr.Want != 2 {
+		t.Errorf("Unmarshal({1,2,3}) = %v, want *FieldCountError 3 vs 2", err)
+	}
+}
+
+func TestNonStrict(t *testing.T) {
+	type record struct {
+		A int
+		C string
+	}
+	for _, tt := range []struct {
+		in   string
+		want record
+	}{
+		{`{1,"x",3}`, record{1, "x"}}, // excess field
+		{`{1,x}`, record{1, "x"}},     // bare word for a string
+		{`{1,"x"]`, record{1, "x"}},   // wrong delimiter
+	} {
+		dec := NewDecoder(strings.NewReader(tt.in))
+		dec.SetStrict(false)
+		var v record
+		if err := dec.Decode(&v); err != nil || v != tt.want {
+			t.Errorf("non-strict Decode(%q) = %+v, %v; want %+v", tt.in, v, err, tt.want)
+		}
+	}
+}
+
+func TestSchemaPolicy(t *testing.T) {
+	type record struct{ A, B int }
+	const (
+		short = "{1}\n"
+		exact = "{1,2}\n"
+		long  = "{1,2,3}\n"
+		empty = "{1,2,,}\n" // empty trailing slots are not extras
+	)
+	for _, tt := range []struct {
+		policy SchemaPolicy
+		in     string
+		ok     bool
+	}{
+		{0, exact, true},
+		{0, empty, true},
+		{0, short, false},
+		{0, long, false},
+		{AllowMissingFields, short, true},
+		{AllowMissingFields, long, false},
+		{AllowExtraFields, short, false},
+		{AllowExtraFields, long, true},
+		{AllowMissingFields | AllowExtraFields, short, true},
+		{AllowMissingFields | AllowExtraFields, long, true},
+	} {
+		dec := NewDecoder(strings.NewReader(tt.in))
+		dec.SetSchemaPolicy(tt.policy)
+		v := record{B: 9}
+		err := dec.Decode(&v)
+		if !tt.ok {
+			var fcerr *FieldCountError
+			if !errors.As(err, &fcerr) {
+				t.Errorf("policy %d: Decode(%q) = %v, want *FieldCountError", tt.policy, tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("policy %d: Decode(%q): %v", tt.policy, tt.in, err)
+			continue
+		}
+		want := record{1, 2}
+		if tt.in == short {
+			want.B = 9 // missing fields are left untouched
+		}
+		if v != want {
+			t.Errorf("policy %d: Decode(%q) = %+v, want %+v", tt.policy, tt.in, v, want)
+		}
+	}
+}
+
+func TestDefaultSchemaPolicy(t *testing.T) {
+	type record struct{ A, B int }
+	var v record
+	dec := NewDecoder(strings.NewReader("{1}\n{1,2,3}\n"))
+	if err := dec.Decode(&v); err != nil {
+		t.Errorf("Decode(short record): %v", err)
+	}
+	var fcerr *FieldCountError
+	if err := dec.Decode(&v); !errors.As(err, &fcerr) {
+		t.Errorf("Decode(long record) = %v, want *FieldCountError", err)
+	}
+}
+
+func TestFieldCountError(t *testing.T) {
+	type inner struct{ X, Y int }
+	type outer struct {
+		Name  string
+		Items []inner
+	}
+	var v outer
+	dec := NewDecoder(strings.NewReader("{\"a\",[{1,2}]}\n{\"a\",[{1,2},{1,2,3}]}\n"))
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	err := dec.Decode(&v)
+	var fcerr *FieldCountError
+	if !errors.As(err, &fcerr) {
+		t.Fatalf("Decode = %v, want *FieldCountError", err)
+	}
+	want := FieldCountError{Type: reflect.TypeOf(inner{}), Got: 3, Want: 2, Offset: 26, Field: "Items[1]"}
+	if *fcerr != want {
+		t.Errorf("FieldCountError = %+v, want %+v", *fcerr, want)
+	}
+	if msg := fcerr.Error(); !strings.Contains(msg, "Items[1]") {
+		t.Errorf("Error() = %q, want the field path", msg)
+	}
+}
+
+func TestFieldCountMismatches(t *testing.T) {
+	type inner struct{ X, Y int }
+	type outer struct {
+		Name string
+		In   inner
+		M    map[string]inner
+	}
+	dec := NewDecoder(strings.NewReader("{\"a\",{1},<\"k\":{1,2,3}>}\n{\"b\",{1,2},<>}\n{\"c\"}\n"))
+	dec.SetSchemaPolicy(AllowMissingFields | AllowExtraFields)
+
+	var v outer
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	innerType := reflect.TypeOf(inner{})
+	want := []*FieldCountError{
+		{Type: innerType, Got: 1, Want: 2, Offset: 5, Field: "In"},
+		{Type: innerType, Got: 3, Want: 2, Offset: 14, Field: `M["k"]`},
+	}
+	if got := dec.FieldCountMismatches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FieldCountMismatches = %+v, want %+v", got, want)
+	}
+
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got := dec.FieldCountMismatches(); got != nil {
+		t.Errorf("FieldCountMismatches after matching record = %+v, want nil", got)
+	}
+
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	want = []*FieldCountError{{Type: reflect.TypeOf(outer{}), Got: 1, Want: 3, Offset: 39}}
+	if got := dec.FieldCountMismatches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FieldCountMismatches = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeprecatedSlot(t *testing.T) {
+	type v1 struct {
+		Name  string
+		Phone string
+		Age   int
+	}
+	type v2 struct {
+		Name string
+		_    struct{} `ido:",deprecated"`
+		Age  int
+	}
+	data, err := Marshal(v1{"Ann", "555", 30})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out v2
+	if err := Unmarshal(data, &out); err != nil || out.Name != "Ann" || out.Age != 30 {
+		t.Errorf("Unmarshal(%s) = %+v, %v; want Ann 30", data, out, err)
+	}
+	if data, _ := Marshal(v2{Name: "Ann", Age: 30}); string(data) != `{"Ann",,30}` {
+		t.Errorf("Marshal(v2) = %s, want {\"Ann\",,30}", data)
+	}
+
+	// A hole, unlike a deprecated slot, must stay empty in strict mode.
+	type v3 struct {
+		Name string
+		Age  int `ido:"2"`
+	}
+	var hole v3
+	var terr *UnmarshalTypeError
+	if err := Unmarshal(data, &hole); !errors.As(err, &terr) {
+		t.Errorf("Unmarshal(%s) into struct with hole = %v, want *UnmarshalTypeError", data, err)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{`"plain"`, "plain"},
+		{`"\" \\ \n \r \t"`, "\" \\ \n \r \t"},
+		{`"\u00e9"`, "\u00e9"},
+		{`"\u0000\u001f\u007f"`, "\x00\x1f\x7f"},
+		{`"\ud83d\ude00"`, "\U0001F600"},             // surrogate pair
+		{`"\uD83D\uDE00"`, "\U0001F600"},             // upper-case hex
+		{`"\ud83d"`, "\uFFFD"},                       // lone high surrogate
+		{`"\ude00"`, "\uFFFD"},                       // lone low surrogate
+		{`"\ud83dx"`, "\uFFFDx"},                     // high surrogate before a plain byte
+		{`"\ud83d\u0041"`, "\uFFFDA"},                // high surrogate before a non-surrogate
+		{`"\ud83d\ud83d\ude00"`, "\uFFFD\U0001F600"}, // two highs, then a low
+		{`"\ude00\ud83d"`, "\uFFFD\uFFFD"},           // low before high is not a pair
+	} {
+		var got string
+		if err := Unmarshal([]byte(tt.in), &got); err != nil || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+q, %v; want %+q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidEscape(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		offset int64
+	}{
+		{`"\q"`, 1},
+		{`"ab\x41"`, 3},
+		{`"\u12"`, 1},
+		{`"\u12zz"`, 1},
+		{`"ok\ud83d\u12"`, 9}, // a bad escape after a high surrogate
+		{`"\`, 0},             // unterminated
+		{`{1,"a\/"}`, 5},
+		{`<"k\0":1>`, 3},
+	} {
+		var v any
+		var serr *SyntaxError
+		if err := Unmarshal([]byte(tt.in), &v); !errors.As(err, &serr) || serr.Offset != tt.offset {
+			t.Errorf("Unmarshal(%s) = %v, want *SyntaxError at offset %d", tt.in, err, tt.offset)
+		}
+		if err := Validate([]byte(tt.in)); !errors.As(err, &serr) || serr.Offset != tt.offset {
+			t.Errorf("Validate(%s) = %v, want *SyntaxError at offset %d", tt.in, err, tt.offset)
+		}
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	roundTrip := func(s string) bool {
+		data, err := Marshal(s)
+		if err != nil || bytes.ContainsAny(data, "\n\r") {
+			return false
+		}
+		var out string
+		return Unmarshal(data, &out) == nil && out == s
+	}
+	for c := 0; c < 0x100; c++ {
+		if s := string([]byte{'a', byte(c), 'z'}); !roundTrip(s) {
+			t.Errorf("byte %#x does not round trip", c)
+		}
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+	// Arbitrary bytes, including invalid UTF-8, are kept as they are.
+	if err := quick.Check(func(b []byte) bool { return roundTrip(string(b)) }, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	type inner struct {
+		N int
+		F float64
+	}
+	type record struct {
+		Name  string
+		Age   int
+		OK    bool
+		List  []uint
+		M     map[string]inner
+		Raw   []byte
+		Maybe *int
+	}
+	want := record{"John", 30, true, []uint{1, 2}, map[string]inner{"k": {-3, 0.5}}, []byte{1, 2}, nil}
+	for _, in := range []string{
+		`{"John",30,+,[1,2],<"k":{-3,0.5}>,b"AQI=",~}`,
+		"{ \"John\" , 30 , + , [ 1 , 2 ] , < \"k\" : { -3 , 0.5 } > , b\"AQI=\" , ~ }",
+		"\t{\"John\",\t30,\r\n+,[1,\n2],<\"k\"\n:\n{-3,0.5}>,b\"AQI=\",~}\n",
+		"{\n    \"John\", // Name\n    30,\n    +,\n    [\n        1,\n        2\n    ],\n" +
+			"    <\n        \"k\": {\n            -3,\n            0.5\n        }\n    >,\n    b\"AQI=\",\n    ~\n}",
+	} {
+		var v record
+		if err := Unmarshal([]byte(in), &v); err != nil {
+			t.Errorf("Unmarshal(%q): %v", in, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("Unmarshal(%q) = %+v, want %+v", in, v, want)
+		}
+	}
+
+	// Whitespace inside a string is part of it.
+	var s string
+	if err := Unmarshal([]byte(`  " a b "  `), &s); err != nil || s != " a b " {
+		t.Errorf("Unmarshal = %q, %v; want %q", s, err, " a b ")
+	}
+	// A multi-line record read from a stream ends at its closing delimiter.
+	dec := NewDecoder(strings.NewReader("{\n  1,\n  2\n}\n{3,4}\n"))
+	var p struct{ A, B int }
+	for _, want := range []int{1, 3} {
+		if err := dec.Decode(&p); err != nil || p.A != want {
+			t.Errorf("Decode = %+v, %v; want A %d", p, err, want)
+		}
+	}
+}
+
+func TestIntegerOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		in string
+		v  any
+		ok bool
+	}{
+		{"127", new(int8), true},
+		{"-128", new(int8), true},
+		{"128", new(int8), false},
+		{"300", new(int8), false},
+		{"-129", new(int8), false},
+		{"32767", new(int16), true},
+		{"32768", new(int16), false},
+		{"-2147483649", new(int32), false},
+		{"9223372036854775807", new(int64), true},
+		{"9223372036854775808", new(int64), false},
+		{"255", new(uint8), true},
+		{"256", new(uint8), false},
+		{"-1", new(uint), false},
+		{"4294967296", new(uint32), false},
+		{"18446744073709551615", new(uint64), true},
+		{"18446744073709551616", new(uint64), false},
+		{"1.0", new(int), false},
+		{"1e3", new(int), false},
+	} {
+		err := Unmarshal([]byte(tt.in), tt.v)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("Unmarshal(%s) into %T: %v", tt.in, tt.v, err)
+			} else if got := reflect.ValueOf(tt.v).Elem(); intString(got) != tt.in {
+				t.Errorf("Unmarshal(%s) into %T = %s", tt.in, tt.v, intString(got))
+			}
+			continue
+		}
+		var terr *UnmarshalTypeError
+		if !errors.As(err, &terr) || terr.Type != reflect.TypeOf(tt.v).Elem() {
+			t.Errorf("Unmarshal(%s) into %T = %v, want *UnmarshalTypeError", tt.in, tt.v, err)
+		}
+	}
+
+	// The error names the field, and the field keeps its old value.
+	v := struct {
+		A int8
+		B []uint16
+	}{A: 1}
+	var terr *UnmarshalTypeError
+	if err := Unmarshal([]byte(`{2,[1,70000]}`), &v); !errors.As(err, &terr) || terr.Field != "B[1]" || terr.Offset != 6 {
+		t.Errorf("Unmarshal = %v, want *UnmarshalTypeError for B[1] at offset 6", err)
+	}
+	if err := Unmarshal([]byte(`{-200}`), &v); !errors.As(err, &terr) || v.A != 2 {
+		t.Errorf("Unmarshal({-200}) = %v, A = %d; want *UnmarshalTypeError and A unchanged", err, v.A)
+	}
+}
+
+func intString(v reflect.Value) string {
+	if v.CanInt() {
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return strconv.FormatUint(v.Uint(), 10)
+}
+
+func TestFloat32Precision(t *testing.T) {
+	for _, tt := range []struct {
+		in        string
+		strict    bool
+		nonStrict bool
+	}{
+		{"0.1", true, true},
+		{"1.5", true, true},
+		{"16777216", true, true},
+		{"3.4028235e38", true, true},
+		{"NaN", true, true},
+		{"-Inf", true, true},
+		{"16777217", false, true},     // needs 25 bits of mantissa
+		{"0.1000000001", false, true}, // more digits than float32 holds
+		{"3.5e38", false, false},      // out of range
+		{"1e-50", false, true},        // underflows to zero
+	} {
+		for strict, ok := range map[bool]bool{true: tt.strict, false: tt.nonStrict} {
+			dec := NewDecoder(strings.NewReader(tt.in))
+			dec.SetStrict(strict)
+			var f float32
+			if err := dec.Decode(&f); (err == nil) != ok {
+				t.Errorf("strict=%v: Decode(%s) into float32 = %g, %v; want ok %v", strict, tt.in, f, err, ok)
+			}
+		}
+	}
+
+	var f64 float64
+	if err := Unmarshal([]byte("0.1000000001"), &f64); err != nil || f64 != 0.1000000001 {
+		t.Errorf("Unmarshal into float64 = %g, %v", f64, err)
+	}
+}
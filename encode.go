@@ -1,9 +1,15 @@
 package ido
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -23,17 +29,65 @@ type Marshaler interface {
 // SHARED & CACHE
 // ---------------------------------------------------------
 
-// bufferPool reuses byte slices to prevent massive GC pressure during Marshal.
-var bufferPool = sync.Pool{
+// encodeState carries the output buffer and per-call options through the
+// compiled encoders.
+type encodeState struct {
+	buf          []byte
+	annotate     bool // follow every struct field with a // Name comment
+	explicitZero bool // write zero values and nils instead of empty slots
+	timeFormat   TimeFormat
+
+	rejectNonFinite bool // fail on NaN and ±Inf instead of writing them
+}
+
+// statePool reuses encode states to prevent massive GC pressure during Marshal.
+var statePool = sync.Pool{
 	New: func() any {
-		b := make([]byte, 0, 512)
-		return &b
+		return &encodeState{buf: make([]byte, 0, 512)}
 	},
 }
 
+func newEncodeState() *encodeState {
+	e := statePool.Get().(*encodeState)
+	*e = encodeState{buf: e.buf[:0]}
+	return e
+}
+
+func (e *encodeState) setOptions(o MarshalOptions) {
+	e.explicitZero = o.ExplicitZero
+	e.timeFormat = o.TimeFormat
+	e.rejectNonFinite = o.RejectNonFinite
+}
+
+// writeNil writes a nil pointer, slice, map or interface: the null marker
+// '~' in explicit-zero mode and an empty slot otherwise.
+func (e *encodeState) writeNil() {
+	if e.explicitZero {
+		e.buf = append(e.buf, '~')
+	}
+}
+
+// marshal appends the encoding of v to e.buf.
+func (e *encodeState) marshal(v any) error {
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		e.writeNil()
+		return nil
+	}
+	encoder, err := getEncoder(val.Type())
+	if err != nil {
+		return err
+	}
+	return encoder(e, val)
+}
+
 // timeType is shared across the package
 var timeType = reflect.TypeOf(time.Time{})
+var durationType = reflect.TypeOf(time.Duration(0))
 var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+var numberType = reflect.TypeOf(Number(""))
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 
 // unsafeString converts []byte to string without allocation.
 // Defined here and used by decode.go as well.
@@ -41,7 +95,7 @@ func unsafeString(b []byte) string {
 	return unsafe.String(unsafe.SliceData(b), len(b))
 }
 
-type encoderFunc func(b *[]byte, v reflect.Value) error
+type encoderFunc func(e *encodeState, v reflect.Value) error
 
 var encoderCache sync.Map // map[reflect.Type]encoderFunc
 
@@ -52,6 +106,14 @@ var encoderCache sync.Map // map[reflect.Type]encoderFunc
 // Encoder writes IDO values to an output stream.
 type Encoder struct {
 	w io.Writer
+
+	prefix    string
+	indent    string
+	indentBuf bytes.Buffer
+	opts      MarshalOptions
+
+	schemaHeader bool
+	headerType   reflect.Type // type of the last header written
 }
 
 // NewEncoder returns a new encoder that writes to w.
@@ -59,31 +121,134 @@ func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: w}
 }
 
-// Encode writes the IDO encoding of v to the stream.
+// Encode writes the IDO encoding of v to the stream, followed by a newline.
+// Every record occupies its own line (or, when indented, lines), so any
+// value, including a bare string, number or empty value, can be read back
+// with Decoder.Decode. Blank lines are not records, so a value that would
+// be an empty slot, such as nil or false, is written explicitly as '~' or
+// '-' at the top level.
 func (e *Encoder) Encode(v any) error {
-	bufPtr := bufferPool.Get().(*[]byte)
-	*bufPtr = (*bufPtr)[:0]
+	es := newEncodeState()
+	defer statePool.Put(es)
 
-	val := reflect.ValueOf(v)
-	encoder, err := getEncoder(val.Type())
-	if err != nil {
-		bufferPool.Put(bufPtr)
-		return err
+	if e.schemaHeader {
+		if err := e.writeHeader(es, reflect.TypeOf(v)); err != nil {
+			return err
+		}
 	}
 
-	if err := encoder(bufPtr, val); err != nil {
-		bufferPool.Put(bufPtr)
+	es.setOptions(e.opts)
+	if err := es.marshal(v); err != nil {
 		return err
 	}
+	if len(es.buf) == 0 {
+		es.explicitZero = true
+		if err := es.marshal(v); err != nil {
+			return err
+		}
+		if len(es.buf) == 0 {
+			es.buf = append(es.buf, '~') // a Marshaler with empty output
+		}
+	}
+
+	// A newline outside a container ends the record, so the record itself
+	// must not contain one. Only a Marshaler can produce one here; compact
+	// its output rather than break the framing.
+	e.indentBuf.Reset()
+	switch {
+	case e.prefix != "" || e.indent != "":
+		if err := Indent(&e.indentBuf, es.buf, e.prefix, e.indent); err != nil {
+			return err
+		}
+		es.buf = append(es.buf[:0], bytes.TrimRight(e.indentBuf.Bytes(), "\n")...)
+	case bytes.IndexByte(es.buf, '\n') >= 0:
+		if err := Compact(&e.indentBuf, es.buf); err != nil {
+			return err
+		}
+		es.buf = append(es.buf[:0], e.indentBuf.Bytes()...)
+	}
+	es.buf = append(es.buf, '\n')
+
+	_, err := e.w.Write(es.buf)
+	return err
+}
 
-	*bufPtr = append(*bufPtr, '\n')
+// SetIndent instructs the encoder to format each subsequent record as if
+// indented by the package-level function Indent(dst, src, prefix, indent).
+// Calling SetIndent("", "") disables indentation.
+func (e *Encoder) SetIndent(prefix, indent string) {
+	e.prefix = prefix
+	e.indent = indent
+}
+
+// SetExplicitZero controls how zero values are written. By default a zero
+// field is an empty slot, which the decoder treats as "not provided" and
+// leaves untouched. With explicit zeros on, every value is written out:
+// false as '-', nil pointers, slices, maps and interfaces as the null
+// marker '~', and other zero values literally, so a decoder can tell an
+// explicit zero or nil apart from an absent value.
+func (e *Encoder) SetExplicitZero(on bool) {
+	e.opts.ExplicitZero = on
+}
+
+// TimeFormat selects how time.Time values are written. The decoder reads
+// either format regardless of which one wrote the data.
+type TimeFormat uint8
+
+const (
+	// TimeUnixMicro writes microseconds since the Unix epoch as an
+	// integer. It is compact but drops nanoseconds and the time zone;
+	// values decode in UTC. It is the default.
+	TimeUnixMicro TimeFormat = iota
+
+	// TimeRFC3339 writes a string in RFC 3339 format with nanoseconds and
+	// the zone offset, e.g. "2006-01-02T15:04:05.999999999+07:00".
+	TimeRFC3339
+)
+
+// SetTimeFormat selects how the encoder writes time.Time values.
+func (e *Encoder) SetTimeFormat(f TimeFormat) {
+	e.opts.TimeFormat = f
+}
+
+// SetRejectNonFinite controls how NaN and infinite floats are handled. By
+// default they are written as the literals NaN, Inf and -Inf; when on,
+// encoding one fails with an *UnsupportedValueError instead, for data
+// bound for consumers that cannot represent them.
+func (e *Encoder) SetRejectNonFinite(on bool) {
+	e.opts.RejectNonFinite = on
+}
 
-	if _, err := e.w.Write(*bufPtr); err != nil {
-		bufferPool.Put(bufPtr)
+// SetSchemaHeader controls whether the encoder describes its records. When
+// on, the first record is preceded by a header line holding the Schema of
+// its type, which Decoder checks against the type it decodes into. A new
+// header is written whenever the type of the records changes.
+func (e *Encoder) SetSchemaHeader(on bool) {
+	e.schemaHeader = on
+	e.headerType = nil
+}
+
+// writeHeader writes the schema header for records of type t unless it is
+// already in effect. The header is '#' followed by the encoded Schema.
+func (e *Encoder) writeHeader(es *encodeState, t reflect.Type) error {
+	if t == nil || t == e.headerType {
+		return nil
+	}
+	schema, err := schemaOf(t)
+	if err != nil {
 		return err
 	}
 
-	bufferPool.Put(bufPtr)
+	es.buf = append(es.buf[:0], '#')
+	if err := es.marshal(schema); err != nil {
+		return err
+	}
+	es.buf = append(es.buf, '\n')
+	if _, err := e.w.Write(es.buf); err != nil {
+		return err
+	}
+	es.buf = es.buf[:0]
+	e.headerType = t
 	return nil
 }
 
@@ -93,25 +258,29 @@ func (e *Encoder) Encode(v any) error {
 
 // Marshal encodes any struct into your custom format using pre-computed encoders.
 func Marshal(v any) ([]byte, error) {
-	bufPtr := bufferPool.Get().(*[]byte)
-	*bufPtr = (*bufPtr)[:0]
+	return MarshalOptions{}.Marshal(v)
+}
 
-	val := reflect.ValueOf(v)
-	encoder, err := getEncoder(val.Type())
-	if err != nil {
-		bufferPool.Put(bufPtr)
-		return nil, err
-	}
+// MarshalOptions configures Marshal and MarshalIndent the way the Encoder
+// setters configure a stream. The zero value gives the defaults.
+type MarshalOptions struct {
+	ExplicitZero    bool       // as Encoder.SetExplicitZero
+	TimeFormat      TimeFormat // as Encoder.SetTimeFormat
+	RejectNonFinite bool       // as Encoder.SetRejectNonFinite
+}
+
+// Marshal is like the package-level Marshal but applies the options in o.
+func (o MarshalOptions) Marshal(v any) ([]byte, error) {
+	e := newEncodeState()
+	defer statePool.Put(e)
 
-	if err := encoder(bufPtr, val); err != nil {
-		bufferPool.Put(bufPtr)
+	e.setOptions(o)
+	if err := e.marshal(v); err != nil {
 		return nil, err
 	}
 
-	result := make([]byte, len(*bufPtr))
-	copy(result, *bufPtr)
-	bufferPool.Put(bufPtr)
-
+	result := make([]byte, len(e.buf))
+	copy(result, e.buf)
 	return result, nil
 }
 
@@ -134,8 +303,9 @@ func getEncoder(t reflect.Type) (encoderFunc, error) {
 func compileEncoder(t reflect.Type) (encoderFunc, error) {
 	// 1. Check for Marshaler interface
 	if t.Implements(marshalerType) {
-		return func(b *[]byte, v reflect.Value) error {
+		return func(e *encodeState, v reflect.Value) error {
 			if v.Kind() == reflect.Pointer && v.IsNil() {
+				e.writeNil()
 				return nil
 			}
 			m, ok := v.Interface().(Marshaler)
@@ -147,18 +317,48 @@ func compileEncoder(t reflect.Type) (encoderFunc, error) {
 			if err != nil {
 				return err
 			}
-			*b = append(*b, data...)
+			e.buf = append(e.buf, data...)
 			return nil
 		}, nil
 	}
 
-	// 2. Standard types
+	// 2. Check if *T implements Marshaler (when we have T). Unaddressable
+	// values are copied so they are written the same way.
+	if t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(marshalerType) {
+		return func(e *encodeState, v reflect.Value) error {
+			if !v.CanAddr() {
+				p := reflect.New(t)
+				p.Elem().Set(v)
+				v = p.Elem()
+			}
+			data, err := v.Addr().Interface().(Marshaler).MarshalIDO()
+			if err != nil {
+				return err
+			}
+			e.buf = append(e.buf, data...)
+			return nil
+		}, nil
+	}
+
+	// 3. Fall back to encoding.TextMarshaler, unless the type only has the
+	// decoding half of Marshaler and Unmarshaler.
+	if isTextType(t, textMarshalerType) && !customEncoding(t) {
+		return compileTextEncoder(t), nil
+	}
+
+	// 4. Standard types
 	switch t.Kind() {
 	case reflect.String:
+		if t == numberType {
+			return encodeNumber, nil
+		}
 		return encodeString, nil
 	case reflect.Bool:
 		return encodeBool, nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t == durationType {
+			return encodeDuration, nil
+		}
 		return encodeInt, nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		return encodeUint, nil
@@ -166,8 +366,13 @@ func compileEncoder(t reflect.Type) (encoderFunc, error) {
 		return encodeFloat32, nil
 	case reflect.Float64:
 		return encodeFloat64, nil
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
+		if isByteSeq(t) {
+			return compileBytesEncoder(t), nil
+		}
 		return compileSliceEncoder(t)
+	case reflect.Map:
+		return compileMapEncoder(t)
 	case reflect.Struct:
 		if t == timeType {
 			return encodeTime, nil
@@ -178,147 +383,450 @@ func compileEncoder(t reflect.Type) (encoderFunc, error) {
 		if err != nil {
 			return nil, err
 		}
-		return func(b *[]byte, v reflect.Value) error {
+		// A non-nil pointer must not read back as nil, so its element is
+		// never left as an empty slot: a zero element is written in its
+		// explicit-zero form, and a nil map or slice as an empty one,
+		// since '~' would set the pointer itself to nil.
+		var empty reflect.Value
+		switch t.Elem().Kind() {
+		case reflect.Map:
+			empty = reflect.MakeMap(t.Elem())
+		case reflect.Slice:
+			empty = reflect.MakeSlice(t.Elem(), 0, 0)
+		}
+		return func(e *encodeState, v reflect.Value) error {
 			if v.IsNil() {
+				e.writeNil()
 				return nil
 			}
-			return elemEnc(b, v.Elem())
+			elem := v.Elem()
+			if empty.IsValid() && elem.IsNil() {
+				elem = empty
+			}
+			start := len(e.buf)
+			if err := elemEnc(e, elem); err != nil || len(e.buf) > start || e.explicitZero {
+				return err
+			}
+			e.explicitZero = true
+			err := elemEnc(e, elem)
+			e.explicitZero = false
+			return err
 		}, nil
 	case reflect.Interface:
-		return func(b *[]byte, v reflect.Value) error {
+		// Only an empty interface can decode an untagged value, into its
+		// generic form; any other needs the registered type name.
+		needTag := t.NumMethod() > 0
+		return func(e *encodeState, v reflect.Value) error {
 			if v.IsNil() {
+				e.writeNil()
 				return nil
 			}
-			enc, err := getEncoder(v.Elem().Type())
+			elem := v.Elem()
+			enc, err := getEncoder(elem.Type())
 			if err != nil {
 				return err
 			}
-			return enc(b, v.Elem())
+			if name, ok := registeredName(elem.Type()); ok {
+				e.buf = append(e.buf, '@')
+				e.buf = append(e.buf, name...)
+				e.buf = append(e.buf, ':')
+			} else if needTag {
+				return fmt.Errorf("ido: type %s stored in %s is not registered", elem.Type(), t)
+			}
+			return enc(e, elem)
 		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported type: %s", t)
 	}
 }
 
+// isTextType reports whether values of t, or pointers to them, implement
+// iface, one of the encoding.Text interfaces. time.Time has its own
+// encoding, and pointers and interfaces are resolved before their values
+// are checked.
+func isTextType(t, iface reflect.Type) bool {
+	if t == timeType || t.Kind() == reflect.Pointer || t.Kind() == reflect.Interface {
+		return false
+	}
+	return t.Implements(iface) || reflect.PointerTo(t).Implements(iface)
+}
+
+// compileTextEncoder writes the MarshalText output of t as a string.
+func compileTextEncoder(t reflect.Type) encoderFunc {
+	byValue := t.Implements(textMarshalerType)
+	return func(e *encodeState, v reflect.Value) error {
+		if !byValue {
+			if !v.CanAddr() {
+				p := reflect.New(t)
+				p.Elem().Set(v)
+				v = p.Elem()
+			}
+			v = v.Addr()
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.buf = appendQuoted(e.buf, unsafeString(text))
+		return nil
+	}
+}
+
+// isByteSeq reports whether t is a []byte or [N]byte, which are written as
+// b"base64" rather than element by element. Byte types with their own
+// encoding keep it.
+func isByteSeq(t reflect.Type) bool {
+	elem := t.Elem()
+	return elem.Kind() == reflect.Uint8 && !customEncoding(elem) &&
+		!isTextType(elem, textMarshalerType) && !isTextType(elem, textUnmarshalerType)
+}
+
+// compileBytesEncoder writes a byte slice or array as b"..." holding its
+// standard base64 encoding.
+func compileBytesEncoder(t reflect.Type) encoderFunc {
+	isSlice := t.Kind() == reflect.Slice
+	return func(e *encodeState, v reflect.Value) error {
+		var b []byte
+		switch {
+		case isSlice:
+			if v.IsNil() && e.explicitZero {
+				e.writeNil()
+				return nil
+			}
+			b = v.Bytes()
+		case v.CanAddr():
+			b = v.Bytes()
+		default:
+			// Bytes needs an addressable array. Copying into one also
+			// works for named byte element types, which reflect.Copy
+			// into a []byte would reject.
+			a := reflect.New(t).Elem()
+			a.Set(v)
+			b = a.Bytes()
+		}
+
+		n := base64.StdEncoding.EncodedLen(len(b))
+		e.buf = append(e.buf, 'b', '"')
+		e.buf = slices.Grow(e.buf, n+1)
+		base64.StdEncoding.Encode(e.buf[len(e.buf):len(e.buf)+n], b)
+		e.buf = append(e.buf[:len(e.buf)+n], '"')
+		return nil
+	}
+}
+
 func compileStructEncoder(t reflect.Type) (encoderFunc, error) {
 	type fieldInfo struct {
-		idx     int
-		encoder encoderFunc
+		index   []int
+		label   string
+		encoder encoderFunc // nil for a hole
 	}
-	var fields []fieldInfo
 
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		if f.Tag.Get("ido") == "-" {
+	slots, err := structFields(t)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]fieldInfo, len(slots))
+	for i, f := range slots {
+		if f.index == nil {
 			continue
 		}
-		enc, err := compileEncoder(f.Type)
-		if err != nil {
-			return nil, err
+		enc := encodeJSON
+		if !f.json {
+			var err error
+			if enc, err = compileEncoder(t.FieldByIndex(f.index).Type); err != nil {
+				return nil, err
+			}
 		}
-		fields = append(fields, fieldInfo{idx: i, encoder: enc})
+		fields[i] = fieldInfo{index: f.index, label: f.label, encoder: enc}
 	}
 
-	return func(b *[]byte, v reflect.Value) error {
-		*b = append(*b, '{')
-		for _, field := range fields {
-			fv := v.Field(field.idx)
-			if fv.IsZero() {
-				*b = append(*b, ',')
-				continue
+	return func(e *encodeState, v reflect.Value) error {
+		e.buf = append(e.buf, '{')
+		for i, field := range fields {
+			// A field inside a nil inlined struct is left empty.
+			if field.encoder != nil {
+				if fv, ok := fieldByIndex(v, field.index, false); ok && (e.explicitZero || !fv.IsZero()) {
+					if err := field.encoder(e, fv); err != nil {
+						return err
+					}
+				}
 			}
-			if err := field.encoder(b, fv); err != nil {
+			if i < len(fields)-1 {
+				e.buf = append(e.buf, ',')
+			}
+			if e.annotate && field.encoder != nil {
+				e.buf = append(e.buf, "// "...)
+				e.buf = append(e.buf, field.label...)
+				e.buf = append(e.buf, '\n')
+			}
+		}
+		e.buf = append(e.buf, '}')
+		return nil
+	}, nil
+}
+
+func compileSliceEncoder(t reflect.Type) (encoderFunc, error) {
+	elemEnc, err := compileEncoder(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	isSlice := t.Kind() == reflect.Slice
+
+	return func(e *encodeState, v reflect.Value) error {
+		if isSlice && v.IsNil() && e.explicitZero {
+			e.writeNil()
+			return nil
+		}
+
+		e.buf = append(e.buf, '[')
+		l := v.Len()
+		for i := 0; i < l; i++ {
+			if err := elemEnc(e, v.Index(i)); err != nil {
 				return err
 			}
-			*b = append(*b, ',')
+			e.buf = append(e.buf, ',')
 		}
 
-		slice := *b
-		if len(slice) > 1 && slice[len(slice)-1] == ',' {
-			slice[len(slice)-1] = '}'
+		if n := len(e.buf); n > 1 && e.buf[n-1] == ',' {
+			e.buf[n-1] = ']'
 		} else {
-			*b = append(slice, '}')
+			e.buf = append(e.buf, ']')
 		}
 		return nil
 	}, nil
 }
 
-func compileSliceEncoder(t reflect.Type) (encoderFunc, error) {
+// compileMapEncoder writes maps as <key:value,...>. Entries are sorted by
+// their encoded key so the same map always produces the same bytes.
+func compileMapEncoder(t reflect.Type) (encoderFunc, error) {
+	if !isMapKeyKind(t.Key().Kind()) {
+		return nil, fmt.Errorf("unsupported map key type: %s", t.Key())
+	}
+	keyEnc, err := compileEncoder(t.Key())
+	if err != nil {
+		return nil, err
+	}
 	elemEnc, err := compileEncoder(t.Elem())
 	if err != nil {
 		return nil, err
 	}
-	return func(b *[]byte, v reflect.Value) error {
-		*b = append(*b, '[')
-		l := v.Len()
-		for i := 0; i < l; i++ {
-			if err := elemEnc(b, v.Index(i)); err != nil {
+
+	type entry struct {
+		key []byte
+		val reflect.Value
+	}
+
+	return func(e *encodeState, v reflect.Value) error {
+		if v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+
+		entries := make([]entry, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			var ks encodeState
+			if err := keyEnc(&ks, iter.Key()); err != nil {
+				return err
+			}
+			entries = append(entries, entry{key: ks.buf, val: iter.Value()})
+		}
+		slices.SortFunc(entries, func(a, b entry) int {
+			return bytes.Compare(a.key, b.key)
+		})
+
+		e.buf = append(e.buf, '<')
+		for _, ent := range entries {
+			e.buf = append(e.buf, ent.key...)
+			e.buf = append(e.buf, ':')
+			if err := elemEnc(e, ent.val); err != nil {
 				return err
 			}
-			*b = append(*b, ',')
+			e.buf = append(e.buf, ',')
 		}
 
-		slice := *b
-		if len(slice) > 1 && slice[len(slice)-1] == ',' {
-			slice[len(slice)-1] = ']'
+		if n := len(e.buf); n > 1 && e.buf[n-1] == ',' {
+			e.buf[n-1] = '>'
 		} else {
-			*b = append(slice, ']')
+			e.buf = append(e.buf, '>')
 		}
 		return nil
 	}, nil
 }
 
+// isMapKeyKind reports whether maps keyed by k can be encoded. Keys must be
+// scalars so that the first ':' of an entry always separates key from value.
+func isMapKeyKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
 // ---------------------------------------------------------
 // PRIMITIVES (Encoder)
 // ---------------------------------------------------------
 
-func encodeString(b *[]byte, v reflect.Value) error {
-	val := v.String()
-	*b = append(*b, '"')
-	for i := 0; i < len(val); i++ {
-		c := val[i]
-		if c == '"' {
-			*b = append(*b, '\\', '"')
-		} else if c == '\\' {
-			*b = append(*b, '\\', '\\')
-		} else {
-			*b = append(*b, c)
+func encodeString(e *encodeState, v reflect.Value) error {
+	e.buf = appendQuoted(e.buf, v.String())
+	return nil
+}
+
+// appendQuoted appends str as a quoted string, escaping quotes,
+// backslashes and control characters so that the decoder reads back
+// exactly str.
+func appendQuoted(buf []byte, str string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
 		}
 	}
-	*b = append(*b, '"')
+	return append(buf, '"')
+}
+
+// encodeJSON writes the encoding/json form of v as a string, for fields
+// tagged ido:",json".
+func encodeJSON(e *encodeState, v reflect.Value) error {
+	// Pass a pointer so MarshalJSON methods on *T are found, as they are
+	// for addressable values in encoding/json.
+	if !v.CanAddr() {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p.Elem()
+	}
+	b, err := json.Marshal(v.Addr().Interface())
+	if err != nil {
+		return err
+	}
+	e.buf = appendQuoted(e.buf, unsafeString(b))
 	return nil
 }
 
-func encodeBool(b *[]byte, v reflect.Value) error {
-	if v.Bool() {
-		*b = append(*b, '+')
+// encodeNumber writes a Number as its literal. An empty Number is a zero,
+// and any other text that is not a number literal is an error, since it
+// would be read back as something else.
+func encodeNumber(e *encodeState, v reflect.Value) error {
+	n := v.String()
+	if n == "" {
+		if e.explicitZero {
+			e.buf = append(e.buf, '0')
+		}
+		return nil
 	}
+	if !isNumber([]byte(n)) && !isNonFinite([]byte(n)) {
+		return fmt.Errorf("ido: invalid number literal %q", n)
+	}
+	e.buf = append(e.buf, n...)
 	return nil
 }
 
-func encodeInt(b *[]byte, v reflect.Value) error {
-	*b = strconv.AppendInt(*b, v.Int(), 10)
+func encodeBool(e *encodeState, v reflect.Value) error {
+	if v.Bool() {
+		e.buf = append(e.buf, '+')
+	} else if e.explicitZero {
+		e.buf = append(e.buf, '-')
+	}
 	return nil
 }
 
-func encodeUint(b *[]byte, v reflect.Value) error {
-	*b = strconv.AppendUint(*b, v.Uint(), 10)
+func encodeInt(e *encodeState, v reflect.Value) error {
+	e.buf = strconv.AppendInt(e.buf, v.Int(), 10)
 	return nil
 }
 
-func encodeFloat32(b *[]byte, v reflect.Value) error {
-	*b = strconv.AppendFloat(*b, v.Float(), 'f', -1, 32)
+func encodeUint(e *encodeState, v reflect.Value) error {
+	e.buf = strconv.AppendUint(e.buf, v.Uint(), 10)
 	return nil
 }
 
-func encodeFloat64(b *[]byte, v reflect.Value) error {
-	*b = strconv.AppendFloat(*b, v.Float(), 'f', -1, 64)
+func encodeFloat32(e *encodeState, v reflect.Value) error {
+	return e.appendFloat(v, 32)
+}
+
+func encodeFloat64(e *encodeState, v reflect.Value) error {
+	return e.appendFloat(v, 64)
+}
+
+// appendFloat writes the shortest decimal that parses back to the float in
+// v, using an exponent whenever that is shorter, as in "1e20" and "1e-3".
+// Exponents are written without a '+' or leading zeros. Non-finite values
+// are written as NaN, Inf and -Inf.
+func (e *encodeState) appendFloat(v reflect.Value, bits int) error {
+	f := v.Float()
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		if e.rejectNonFinite {
+			return &UnsupportedValueError{Value: v, Str: strconv.FormatFloat(f, 'g', -1, bits)}
+		}
+		switch {
+		case math.IsNaN(f):
+			e.buf = append(e.buf, "NaN"...)
+		case f > 0:
+			e.buf = append(e.buf, "Inf"...)
+		default:
+			e.buf = append(e.buf, "-Inf"...)
+		}
+		return nil
+	}
+
+	start := len(e.buf)
+	e.buf = strconv.AppendFloat(e.buf, f, 'f', -1, bits)
+	mid := len(e.buf)
+	e.buf = strconv.AppendFloat(e.buf, f, 'e', -1, bits)
+
+	// Clean up e-09 to e-9 and e+21 to e21.
+	i := mid + bytes.LastIndexByte(e.buf[mid:], 'e') + 1
+	exp := i
+	if e.buf[i] == '-' {
+		exp++
+	}
+	digits := i + 1 // skip '+' or '-'
+	for digits < len(e.buf)-1 && e.buf[digits] == '0' {
+		digits++
+	}
+	e.buf = append(e.buf[:exp], e.buf[digits:]...)
+
+	if len(e.buf)-mid < mid-start {
+		e.buf = append(e.buf[:start], e.buf[mid:]...)
+	} else {
+		e.buf = e.buf[:mid]
+	}
 	return nil
 }
 
-func encodeTime(b *[]byte, v reflect.Value) error {
+func encodeTime(e *encodeState, v reflect.Value) error {
 	t := v.Interface().(time.Time)
-	*b = strconv.AppendInt(*b, t.UnixMicro(), 10)
+	if e.timeFormat == TimeRFC3339 {
+		e.buf = append(e.buf, '"')
+		e.buf = t.AppendFormat(e.buf, time.RFC3339Nano)
+		e.buf = append(e.buf, '"')
+		return nil
+	}
+	e.buf = strconv.AppendInt(e.buf, t.UnixMicro(), 10)
+	return nil
+}
+
+// encodeDuration writes a time.Duration as a string in the form of
+// Duration.String, e.g. "1h30m0.5s".
+func encodeDuration(e *encodeState, v reflect.Value) error {
+	e.buf = append(e.buf, '"')
+	e.buf = append(e.buf, time.Duration(v.Int()).String()...)
+	e.buf = append(e.buf, '"')
 	return nil
 }
 
@@ -0,0 +1,643 @@
+package ido
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type namedByte byte
+
+func TestByteSeqRoundTrip(t *testing.T) {
+	type record struct {
+		Raw   []byte
+		Arr   [4]byte
+		Named []namedByte
+		NArr  [4]namedByte
+		Short [4]namedByte
+	}
+	in := record{
+		Raw:   []byte("hello"),
+		Arr:   [4]byte{1, 2, 3, 4},
+		Named: []namedByte{5, 6, 7},
+		NArr:  [4]namedByte{8, 9, 10, 11},
+		Short: [4]namedByte{12},
+	}
+
+	// Marshal by value so the arrays are not addressable.
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Contains(data, []byte(`b"CAkKCw=="`)) {
+		t.Errorf("Marshal = %s, want [4]namedByte as b\"CAkKCw==\"", data)
+	}
+
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestByteSeqLegacyForm(t *testing.T) {
+	var out struct {
+		Named []namedByte
+		NArr  [4]namedByte
+	}
+	if err := Unmarshal([]byte(`{[1,2],b"AQI="}`), &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if want := []namedByte{1, 2}; !reflect.DeepEqual(out.Named, want) {
+		t.Errorf("Named = %v, want %v", out.Named, want)
+	}
+	if want := [4]namedByte{1, 2}; out.NArr != want {
+		t.Errorf("NArr = %v, want %v", out.NArr, want)
+	}
+}
+
+// ptrMarshaler has MarshalIDO and MarshalText on the pointer receiver.
+type ptrMarshaler struct{ N int }
+
+func (p *ptrMarshaler) MarshalIDO() ([]byte, error) {
+	return []byte(strconv.Itoa(p.N)), nil
+}
+
+func (p *ptrMarshaler) UnmarshalIDO(data []byte) error {
+	n, err := strconv.Atoi(string(data))
+	p.N = n
+	return err
+}
+
+func (p *ptrMarshaler) MarshalText() ([]byte, error) { return []byte("text"), nil }
+
+func (p *ptrMarshaler) UnmarshalText([]byte) error { return nil }
+
+func TestPointerMarshalerBeforeText(t *testing.T) {
+	type record struct {
+		P ptrMarshaler
+		Q *ptrMarshaler
+	}
+	in := record{P: ptrMarshaler{7}, Q: &ptrMarshaler{99}}
+	for _, v := range []any{in, &in} {
+		data, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if string(data) != "{7,99}" {
+			t.Errorf("Marshal(%T) = %s, want {7,99}", v, data)
+		}
+		var out record
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("round trip = %+v, want %+v", out, in)
+		}
+	}
+}
+
+func TestNumberRoundTrip(t *testing.T) {
+	type record struct {
+		N Number
+		M map[Number]string
+	}
+	in := record{N: "-1.5e300", M: map[Number]string{"1": "a", "NaN": "b"}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, strict := range []bool{false, true} {
+		dec := NewDecoder(bytes.NewReader(append(data, '\n')))
+		dec.SetStrict(strict)
+		var out record
+		if err := dec.Decode(&out); err != nil {
+			t.Fatalf("Decode(%s) strict=%v: %v", data, strict, err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("round trip strict=%v = %+v, want %+v", strict, out, in)
+		}
+	}
+
+	if data, err := Marshal(Number("1,2")); err == nil {
+		t.Errorf("Marshal(Number(%q)) = %s, want error", "1,2", data)
+	}
+	var n Number
+	if err := Unmarshal([]byte(`"12"`), &n); err == nil {
+		t.Errorf("Unmarshal(%q) into Number = %q, want error", `"12"`, n)
+	}
+}
+
+func TestEncodeNil(t *testing.T) {
+	if data, err := Marshal(nil); err != nil || len(data) != 0 {
+		t.Errorf("Marshal(nil) = %q, %v; want empty record", data, err)
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetExplicitZero(true)
+	if err := enc.Encode(nil); err != nil {
+		t.Fatalf("Encode(nil): %v", err)
+	}
+	if got := buf.String(); got != "~\n" {
+		t.Errorf("Encode(nil) wrote %q, want %q", got, "~\n")
+	}
+}
+
+func TestPointerToZero(t *testing.T) {
+	type record struct {
+		B   *bool
+		I   *int
+		S   *string
+		N   *Number
+		M   *map[string]int
+		L   *[]int
+		Raw *[]byte
+		T   *bool
+		Nil *int
+	}
+	var (
+		f   bool
+		i   int
+		str string
+		n   Number
+		m   map[string]int
+		l   []int
+		raw []byte
+		tr  = true
+	)
+	in := record{B: &f, I: &i, S: &str, N: &n, M: &m, L: &l, Raw: &raw, T: &tr}
+
+	for _, explicit := range []bool{false, true} {
+		data, err := MarshalOptions{ExplicitZero: explicit}.Marshal(in)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		want := `{-,0,"",0,<>,[],b"",+,}`
+		if explicit {
+			want = `{-,0,"",0,<>,[],b"",+,~}`
+		}
+		if string(data) != want {
+			t.Errorf("Marshal explicit=%v = %s, want %s", explicit, data, want)
+		}
+
+		var out record
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if out.B == nil || out.I == nil || out.S == nil || out.N == nil || out.M == nil ||
+			out.L == nil || out.Raw == nil || out.T == nil {
+			t.Errorf("Unmarshal(%s) = %+v, want every pointer but Nil allocated", data, out)
+		}
+		if out.Nil != nil {
+			t.Errorf("Unmarshal(%s): Nil = %v, want nil", data, out.Nil)
+		}
+	}
+}
+
+func TestMarshalOptions(t *testing.T) {
+	type record struct {
+		S string
+		B bool
+		P *int
+		T time.Time
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.FixedZone("", 2*3600))
+	in := record{T: at}
+
+	if data, _ := Marshal(in); string(data) != "{,,,1714972089123456}" {
+		t.Errorf("Marshal = %s", data)
+	}
+	opts := MarshalOptions{ExplicitZero: true, TimeFormat: TimeRFC3339}
+	data, err := opts.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := `{"",-,~,"2024-05-06T07:08:09.123456789+02:00"}`; string(data) != want {
+		t.Errorf("MarshalOptions.Marshal = %s, want %s", data, want)
+	}
+	indented, err := opts.MarshalIndent(in, "", " ")
+	if err != nil {
+		t.Fatalf("MarshalIndent: %v", err)
+	}
+	if want := "{\n \"\",\n -,\n ~,\n \"2024-05-06T07:08:09.123456789+02:00\"\n}"; string(indented) != want {
+		t.Errorf("MarshalOptions.MarshalIndent = %q, want %q", indented, want)
+	}
+
+	var uerr *UnsupportedValueError
+	if _, err := (MarshalOptions{RejectNonFinite: true}).Marshal(math.Inf(1)); !errors.As(err, &uerr) {
+		t.Errorf("Marshal(+Inf) with RejectNonFinite = %v, want *UnsupportedValueError", err)
+	}
+}
+
+func TestFloatFormat(t *testing.T) {
+	for _, tt := range []struct {
+		in   float64
+		want string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{0.5, "0.5"},
+		{100, "100"},
+		{1234567, "1234567"},
+		{1e7, "1e7"},
+		{1e20, "1e20"},
+		{-1.5e300, "-1.5e300"},
+		{0.001, "1e-3"},
+		{0.0123, "0.0123"},
+		{1e-7, "1e-7"},
+		{-2.5e-10, "-2.5e-10"},
+		{123456789e-20, "1.23456789e-12"},
+	} {
+		data, err := Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("Marshal(%g): %v", tt.in, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("Marshal(%g) = %s, want %s", tt.in, data, tt.want)
+		}
+		var out float64
+		if err := Unmarshal(data, &out); err != nil || out != tt.in {
+			t.Errorf("Unmarshal(%s) = %g, %v; want %g", data, out, err, tt.in)
+		}
+	}
+
+	if data, _ := Marshal(float32(1e-3)); string(data) != "1e-3" {
+		t.Errorf("Marshal(float32(1e-3)) = %s, want 1e-3", data)
+	}
+}
+
+func TestMapRoundTrip(t *testing.T) {
+	type record struct {
+		Names  map[string]int
+		ByID   map[int]string
+		Nested map[uint8]map[string][]int
+		Nil    map[string]int
+	}
+	in := record{
+		Names:  map[string]int{"b": 2, "a": 1, "": 0, "q\"uote": 3},
+		ByID:   map[int]string{10: "ten", -1: "neg", 0: "zero", 2: "two"},
+		Nested: map[uint8]map[string][]int{7: {"x": {1, 2}}},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries are sorted by their encoded key bytes.
+	want := `{<"":0,"a":1,"b":2,"q\"uote":3>,<-1:"neg",0:"zero",10:"ten",2:"two">,<7:<"x":[1,2]>>,}`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := Marshal(in); !bytes.Equal(again, data) {
+			t.Fatalf("Marshal is not deterministic: %s, then %s", data, again)
+		}
+	}
+
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	out = record{}
+	if err := NewDecoder(&buf).Decode(&out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("stream round trip = %+v, %v; want %+v", out, err, in)
+	}
+}
+
+func TestMapDecode(t *testing.T) {
+	// Decoding replaces the contents of an existing map and allocates a
+	// nil one.
+	m := map[string]int{"drop": 1, "a": 5}
+	if err := Unmarshal([]byte(`< "a" : 2 , "b":3 >`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a": 2, "b": 3}; !reflect.DeepEqual(m, want) {
+		t.Errorf("Unmarshal = %v, want %v", m, want)
+	}
+	var ids map[int64]bool
+	if err := Unmarshal([]byte(`<3:+,-4:->`), &ids); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64]bool{3: true, -4: false}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Unmarshal = %v, want %v", ids, want)
+	}
+
+	for _, in := range []string{`<a:1>`, `<:1>`, `<"a"1>`, `<"a":1`, `["a",1]`} {
+		var m map[string]int
+		if err := Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("Unmarshal(%s) = %v, want error", in, m)
+		}
+	}
+	var terr *UnmarshalTypeError
+	if err := Unmarshal([]byte(`<"x":1>`), &ids); !errors.As(err, &terr) {
+		t.Errorf("Unmarshal(<\"x\":1>) into map[int64]bool = %v, want *UnmarshalTypeError", err)
+	}
+}
+
+func TestMapUnsupportedKey(t *testing.T) {
+	for _, v := range []any{map[bool]int{true: 1}, map[float64]int{1: 1}, map[[2]int]int{}} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%T) succeeded, want unsupported key error", v)
+		}
+		if err := Unmarshal([]byte(`<>`), reflect.New(reflect.TypeOf(v)).Interface()); err == nil {
+			t.Errorf("Unmarshal into %T succeeded, want unsupported key error", v)
+		}
+	}
+}
+
+func TestArrayRoundTrip(t *testing.T) {
+	type record struct {
+		ID   [16]byte
+		Vec  [3]float64
+		Grid [2][2]int
+		Zero [2]string
+	}
+	in := record{
+		ID:   [16]byte{0: 0xde, 15: 0xad},
+		Vec:  [3]float64{1.5, 0, -2},
+		Grid: [2][2]int{{1, 2}, {3, 4}},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{b"3gAAAAAAAAAAAAAAAAAArQ==",[1.5,0,-2],[[1,2],[3,4]],}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestArrayDecode(t *testing.T) {
+	// Shorter input zero-fills the rest, overwriting what was there.
+	a := [4]int{9, 9, 9, 9}
+	if err := Unmarshal([]byte(`[1,,3]`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if want := [4]int{1, 0, 3, 0}; a != want {
+		t.Errorf("Unmarshal([1,,3]) = %v, want %v", a, want)
+	}
+	if err := Unmarshal([]byte(`[]`), &a); err != nil || a != [4]int{} {
+		t.Errorf("Unmarshal([]) = %v, %v; want all zero", a, err)
+	}
+
+	var terr *UnmarshalTypeError
+	if err := Unmarshal([]byte(`[1,2,3,4,5]`), &a); !errors.As(err, &terr) || terr.Offset != 9 {
+		t.Errorf("Unmarshal(5 elements) into [4]int = %v, want *UnmarshalTypeError at the fifth element", err)
+	}
+	var b [2]byte
+	if err := Unmarshal([]byte(`b"AQID"`), &b); !errors.As(err, &terr) {
+		t.Errorf("Unmarshal(3 bytes) into [2]byte = %v, want *UnmarshalTypeError", err)
+	}
+	var zero [0]int
+	if err := Unmarshal([]byte(`[]`), &zero); err != nil {
+		t.Errorf("Unmarshal([]) into [0]int: %v", err)
+	}
+}
+
+// color is an enum with a text form.
+type color int
+
+func (c color) MarshalText() ([]byte, error) {
+	switch c {
+	case 0:
+		return []byte("red"), nil
+	case 1:
+		return []byte("green"), nil
+	}
+	return nil, fmt.Errorf("invalid color %d", int(c))
+}
+
+func (c *color) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "red":
+		*c = 0
+	case "green":
+		*c = 1
+	default:
+		return fmt.Errorf("unknown color %q", b)
+	}
+	return nil
+}
+
+func TestTextMarshaler(t *testing.T) {
+	type record struct {
+		Addr   netip.Addr
+		Prefix *netip.Prefix
+		Color  color
+		Colors []color
+		ByKey  map[color]int
+	}
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	in := record{
+		Addr:   netip.MustParseAddr("fe80::1"),
+		Prefix: &prefix,
+		Color:  1,
+		Colors: []color{1, 0},
+		ByKey:  map[color]int{0: 1, 1: 2},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"fe80::1","10.0.0.0/8","green",["green","red"],<"green":2,"red":1>}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// The text is escaped like any other string.
+	if data, _ := Marshal(escapedText{}); string(data) != `"a\"b\nc"` {
+		t.Errorf("Marshal(escapedText) = %s, want %s", data, `"a\"b\nc"`)
+	}
+
+	for _, bad := range []string{`{"not an ip"}`, `{,,"blue"}`, `{,,1}`} {
+		var out record
+		if err := Unmarshal([]byte(bad), &out); err == nil {
+			t.Errorf("Unmarshal(%s) = %+v, want error", bad, out)
+		}
+	}
+	if _, err := Marshal(color(7)); err == nil {
+		t.Errorf("Marshal(color(7)) succeeded, want the MarshalText error")
+	}
+}
+
+type escapedText struct{}
+
+func (escapedText) MarshalText() ([]byte, error) { return []byte("a\"b\nc"), nil }
+
+// vendorID only implements the encoding/json interfaces, on the pointer.
+type vendorID struct{ hi, lo uint32 }
+
+func (v *vendorID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%d-%d", v.hi, v.lo))
+}
+
+func (v *vendorID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	_, err := fmt.Sscanf(s, "%d-%d", &v.hi, &v.lo)
+	return err
+}
+
+func TestJSONField(t *testing.T) {
+	type record struct {
+		ID    vendorID       `ido:",json"`
+		Ptr   *vendorID      `ido:",json"`
+		Extra map[string]any `ido:",json"`
+		Name  string
+	}
+	in := record{
+		ID:    vendorID{1, 2},
+		Ptr:   &vendorID{3, 4},
+		Extra: map[string]any{"k": []any{1.5, "x"}},
+		Name:  "n",
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"\"1-2\"","\"3-4\"","{\"k\":[1.5,\"x\"]}","n"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// Without the tag, the unexported fields leave nothing to encode.
+	if data, err := Marshal(struct{ ID vendorID }{vendorID{1, 2}}); err != nil || string(data) != "{{}}" {
+		t.Errorf("Marshal(untagged) = %s, %v; want {{}}", data, err)
+	}
+
+	for _, bad := range []string{`{1}`, `{"not json"}`, `{"\"x\""}`} {
+		var out record
+		if err := Unmarshal([]byte(bad), &out); err == nil {
+			t.Errorf("Unmarshal(%s) = %+v, want error", bad, out)
+		}
+	}
+}
+
+func TestTimeFormats(t *testing.T) {
+	type record struct {
+		At   time.Time
+		Zero time.Time
+		Ptr  *time.Time
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.FixedZone("CEST", 2*3600))
+	in := record{At: at, Ptr: &at}
+
+	// Unix microseconds drop the nanoseconds and the zone.
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{1714972089123456,,1714972089123456}"; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := at.Truncate(time.Microsecond).UTC(); out.At != want || *out.Ptr != want || !out.Zero.IsZero() {
+		t.Errorf("Unmarshal(%s) = %+v, want %v", data, out, want)
+	}
+
+	// RFC 3339 keeps both, on an Encoder as with MarshalOptions.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetTimeFormat(TimeRFC3339)
+	if err := enc.Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	const rfc = `"2024-05-06T07:08:09.123456789+02:00"`
+	if want := "{" + rfc + ",," + rfc + "}\n"; buf.String() != want {
+		t.Errorf("Encode = %s, want %s", buf.String(), want)
+	}
+	out = record{}
+	if err := NewDecoder(&buf).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.At.Equal(at) || out.At.Nanosecond() != at.Nanosecond() {
+		t.Errorf("Decode: At = %v, want %v", out.At, at)
+	}
+	if _, off := out.At.Zone(); off != 2*3600 {
+		t.Errorf("Decode: At has zone offset %d, want %d", off, 2*3600)
+	}
+
+	for _, bad := range []string{`"2024-05-06"`, `"yesterday"`, `1.5`, `+`, `"2024`} {
+		var v time.Time
+		if err := Unmarshal([]byte(bad), &v); err == nil {
+			t.Errorf("Unmarshal(%s) into time.Time = %v, want error", bad, v)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	type record struct {
+		D    time.Duration
+		List []time.Duration
+		M    map[string]time.Duration
+	}
+	in := record{
+		D:    90*time.Minute + 500*time.Millisecond,
+		List: []time.Duration{-time.Second, time.Nanosecond, 0},
+		M:    map[string]time.Duration{"t": 2 * time.Hour},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"1h30m0.5s",["-1s","1ns","0s"],<"t":"2h0m0s">}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out record
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// Older versions wrote integer nanoseconds.
+	var d time.Duration
+	if err := Unmarshal([]byte("1500000000"), &d); err != nil || d != 1500*time.Millisecond {
+		t.Errorf("Unmarshal(1500000000) = %v, %v; want 1.5s", d, err)
+	}
+	for _, bad := range []string{`"90 minutes"`, `"1h`, `1.5`} {
+		if err := Unmarshal([]byte(bad), &d); err == nil {
+			t.Errorf("Unmarshal(%s) into time.Duration = %v, want error", bad, d)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ido
+
+import (
+	"reflect"
+	"strconv"
+	"unsafe"
+)
+
+// ---------------------------------------------------------
+// ERRORS
+// ---------------------------------------------------------
+
+// A SyntaxError describes input that is not well-formed IDO.
+type SyntaxError struct {
+	msg      string
+	Offset   int64  // byte offset at which the error was detected
+	Expected string // the token the decoder expected, if known
+}
+
+func (e *SyntaxError) Error() string {
+	s := "ido: syntax error at offset " + strconv.FormatInt(e.Offset, 10) + ": " + e.msg
+	if e.Expected != "" {
+		s += " (expected " + e.Expected + ")"
+	}
+	return s
+}
+
+// An UnmarshalTypeError describes an IDO value that cannot be stored in a
+// Go value of a specific type.
+type UnmarshalTypeError struct {
+	Value  string       // offending input, truncated to maxErrorValue bytes
+	Type   reflect.Type // type of Go value it could not be assigned to
+	Offset int64        // byte offset of the value in the input
+	Field  string       // path to the field from the root, e.g. "Members[0].Age"
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	s := "ido: cannot unmarshal " + strconv.Quote(e.Value) + " into Go "
+	if e.Field != "" {
+		s += "field " + e.Field + " of "
+	}
+	return s + "type " + e.Type.String() + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+const maxErrorValue = 64
+
+// An UnsupportedValueError is returned when the encoder is asked to encode
+// a value it was configured to reject, such as a non-finite float with
+// SetRejectNonFinite.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "ido: unsupported value: " + e.Str
+}
+
+// A FieldCountError describes a struct record with more or fewer slots than
+// the struct has, which the decoder's SchemaPolicy does not allow. It
+// usually means the record was written by another version of the struct.
+// Mismatches the policy does allow are reported in the same form by
+// Decoder.FieldCountMismatches.
+type FieldCountError struct {
+	Type   reflect.Type // struct type being decoded
+	Got    int          // slots in the record, not counting empty trailing ones
+	Want   int          // slots in the struct
+	Offset int64        // byte offset of the record in the input
+	Field  string       // path to the struct from the root, if nested
+}
+
+func (e *FieldCountError) Error() string {
+	s := "ido: field count mismatch unmarshaling into Go "
+	if e.Field != "" {
+		s += "field " + e.Field + " of "
+	}
+	return s + "type " + e.Type.String() + " at offset " + strconv.FormatInt(e.Offset, 10) +
+		": record has " + strconv.Itoa(e.Got) + ", want " + strconv.Itoa(e.Want)
+}
+
+// addFieldPath prefixes the field path of an UnmarshalTypeError or
+// FieldCountError with name as the error travels up through the containers
+// that hold the value.
+func addFieldPath(err error, name string) error {
+	var field *string
+	switch e := err.(type) {
+	case *UnmarshalTypeError:
+		field = &e.Field
+	case *FieldCountError:
+		field = &e.Field
+	default:
+		return err
+	}
+	switch {
+	case *field == "":
+		*field = name
+	case (*field)[0] == '[':
+		*field = name + *field
+	default:
+		*field = name + "." + *field
+	}
+	return err
+}
+
+// ---------------------------------------------------------
+// DECODE STATE
+// ---------------------------------------------------------
+
+// decodeState carries per-call context through the compiled decoders.
+type decodeState struct {
+	data   []byte // the record being decoded; every token is a subslice of it
+	base   int64  // offset of data within the surrounding stream
+	strict bool   // reject malformed input instead of decoding best-effort
+	policy SchemaPolicy
+
+	mismatches []*FieldCountError // field count mismatches the policy accepted
+}
+
+// offset returns the stream offset of token d, which must be a subslice of
+// s.data.
+func (s *decodeState) offset(d []byte) int64 {
+	if cap(d) == 0 || len(s.data) == 0 {
+		return s.base
+	}
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(s.data)))
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(d)))
+	if p < start || p > start+uintptr(len(s.data)) {
+		return s.base
+	}
+	return s.base + int64(p-start)
+}
+
+func (s *decodeState) syntaxError(d []byte, msg, expected string) error {
+	return &SyntaxError{msg: msg, Offset: s.offset(d), Expected: expected}
+}
+
+func (s *decodeState) typeError(d []byte, t reflect.Type) error {
+	if len(d) > maxErrorValue {
+		d = d[:maxErrorValue]
+	}
+	return &UnmarshalTypeError{Value: string(d), Type: t, Offset: s.offset(d)}
+}
+
+func (s *decodeState) fieldCountError(d []byte, t reflect.Type, got, want int) *FieldCountError {
+	return &FieldCountError{Type: t, Got: got, Want: want, Offset: s.offset(d)}
+}
+
+// addMismatchPath prefixes name to the field paths of the mismatches
+// recorded from index n on, as addFieldPath does for errors.
+func (s *decodeState) addMismatchPath(n int, name string) {
+	for _, m := range s.mismatches[n:] {
+		addFieldPath(m, name)
+	}
+}
+
+// mismatch reports d, which does not have the form expected for t. Values
+// that are well-formed but of another kind are type errors; anything else
+// is a syntax error.
+func (s *decodeState) mismatch(d []byte, t reflect.Type, expected string) error {
+	if len(d) > 0 {
+		switch d[0] {
+		case '"', '{', '[', '<', '@', '+':
+			return s.typeError(d, t)
+		case 'b':
+			if len(d) > 1 && d[1] == '"' {
+				return s.typeError(d, t)
+			}
+		}
+	}
+	if len(d) == 1 && (d[0] == '-' || d[0] == '~') {
+		return s.typeError(d, t)
+	}
+	if isNumber(d) || isNonFinite(d) {
+		return s.typeError(d, t)
+	}
+	return s.syntaxError(d, "invalid value "+strconv.Quote(string(d)), expected)
+}
@@ -0,0 +1,94 @@
+package ido
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type pathMember struct {
+	Name string
+	Age  int
+}
+
+type pathTeam struct {
+	Lead    pathMember
+	Members []pathMember
+	Scores  map[string][2]int
+	ByID    map[int]*pathMember
+}
+
+func TestErrorFieldPath(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		field  string
+		offset int64
+	}{
+		{`{{"a","x"},[],<>,<>}`, "Lead.Age", 6},
+		{`{{"a",1},[{"b",2},{"c",+}],<>,<>}`, "Members[1].Age", 23},
+		{`{{"a",1},[],<"k":[1,"2"]>,<>}`, `Scores["k"][1]`, 20},
+		{`{{"a",1},[],<>,<7:{"d",[]}>}`, "ByID[7].Age", 23},
+	} {
+		var v pathTeam
+		var terr *UnmarshalTypeError
+		err := Unmarshal([]byte(tt.in), &v)
+		if !errors.As(err, &terr) {
+			t.Errorf("Unmarshal(%s) = %v, want *UnmarshalTypeError", tt.in, err)
+			continue
+		}
+		if terr.Field != tt.field || terr.Offset != tt.offset || terr.Type != reflect.TypeOf(0) {
+			t.Errorf("Unmarshal(%s): %s field %q at offset %d, want int field %q at offset %d",
+				tt.in, terr.Type, terr.Field, terr.Offset, tt.field, tt.offset)
+		}
+		if !strings.Contains(err.Error(), "field "+tt.field+" of") {
+			t.Errorf("Error() = %q, want it to name field %s", err, tt.field)
+		}
+	}
+
+	var v pathTeam
+	var fcerr *FieldCountError
+	in := `{{"a",1},[{"b",2,3}],<>,<>}`
+	if err := Unmarshal([]byte(in), &v); !errors.As(err, &fcerr) || fcerr.Field != "Members[0]" || fcerr.Offset != 10 {
+		t.Errorf("Unmarshal(%s) = %v, want *FieldCountError for Members[0] at offset 10", in, err)
+	}
+}
+
+func TestErrorTopLevel(t *testing.T) {
+	var n int
+	var terr *UnmarshalTypeError
+	err := Unmarshal([]byte(`"x"`), &n)
+	if !errors.As(err, &terr) || terr.Field != "" || terr.Offset != 0 || terr.Value != `"x"` {
+		t.Fatalf("Unmarshal(\"x\") into int = %#v, want *UnmarshalTypeError with no field", err)
+	}
+	if want := `ido: cannot unmarshal "\"x\"" into Go type int at offset 0`; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+
+	long := `"` + strings.Repeat("a", 2*maxErrorValue) + `"`
+	if err := Unmarshal([]byte(long), &n); !errors.As(err, &terr) || len(terr.Value) != maxErrorValue {
+		t.Errorf("Unmarshal(long string): Value has %d bytes, want %d", len(terr.Value), maxErrorValue)
+	}
+}
+
+func TestErrorStreamOffset(t *testing.T) {
+	first := `{{"a",1},[],<>,<>}` + "\n" + "\n"
+	second := `{{"a",1},[{"b","x"}],<>,<>}` + "\n"
+	dec := NewDecoder(strings.NewReader(first + second + `{1 2}` + "\n"))
+
+	var v pathTeam
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	var terr *UnmarshalTypeError
+	err := dec.Decode(&v)
+	if want := int64(len(first)) + 15; !errors.As(err, &terr) || terr.Offset != want || terr.Field != "Members[0].Age" {
+		t.Errorf("Decode = %v, want *UnmarshalTypeError for Members[0].Age at offset %d", err, want)
+	}
+
+	var serr *SyntaxError
+	err = dec.Decode(&v)
+	if want := int64(len(first)+len(second)) + 1; !errors.As(err, &serr) || serr.Offset != want {
+		t.Errorf("Decode = %v, want *SyntaxError at offset %d", err, want)
+	}
+}
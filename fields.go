@@ -0,0 +1,188 @@
+package ido
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------
+// STRUCT FIELDS
+// ---------------------------------------------------------
+
+// structField describes one slot of an encoded struct.
+type structField struct {
+	index      []int  // path to the Go field through inlined structs; nil for a hole
+	name       string // Go field name, used in error paths
+	label      string // name= tag option, or the Go name; used by tooling
+	deprecated bool   // slot is reserved; its value is neither written nor read
+	json       bool   // value is stored as its encoding/json form in a string
+}
+
+// SchemaPolicy selects which struct records written for another version of
+// a struct the decoder accepts. The zero policy requires every record to
+// have exactly as many slots as the struct.
+type SchemaPolicy uint8
+
+const (
+	// AllowMissingFields accepts records with fewer slots than the struct,
+	// as written before fields were appended. The fields without a slot are
+	// left untouched.
+	AllowMissingFields SchemaPolicy = 1 << iota
+
+	// AllowExtraFields accepts records with more slots than the struct, as
+	// written after fields were appended. The extra values are ignored.
+	AllowExtraFields
+
+	// DefaultSchemaPolicy is the policy of Unmarshal and of a new Decoder.
+	DefaultSchemaPolicy = AllowMissingFields
+)
+
+// structFields returns the wire layout of struct type t, one entry per slot
+// in position order. A field's position is the one given in its tag as
+// ido:"3" or ido:"pos=3", or the position after the previous field's;
+// positions start at 0. Positions no field claims are holes, written as
+// empty slots. Fields tagged ido:"-" are skipped; a field tagged
+// ido:",deprecated", usually a blank _ struct{}, reserves its position for
+// a retired field whose old values are ignored.
+//
+// A struct field tagged ido:",inline", typically an embedded one, has its
+// own fields laid out in the parent from the inlined field's position on,
+// with their positions counted from there. A field tagged ido:",json" is
+// stored as its encoding/json form in a string. Unexported fields are
+// skipped; tagging one for encoding is an error.
+func structFields(t reflect.Type) ([]structField, error) {
+	var slots []structField
+	if _, err := layoutFields(&slots, t, t, 0, nil); err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// layoutFields places the fields of struct type t into slots, starting at
+// position base. index leads from root, the type being laid out, to t. It
+// returns the position after the last field placed.
+func layoutFields(slots *[]structField, root, t reflect.Type, base int, index []int) (int, error) {
+	pos := base
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("ido")
+		if tag == "-" {
+			continue
+		}
+
+		field := structField{index: append(index[:len(index):len(index)], i), name: f.Name, label: f.Name}
+		inline := false
+		if ok && tag != "" {
+			for _, opt := range strings.Split(tag, ",") {
+				key, value, hasValue := strings.Cut(opt, "=")
+				switch {
+				case opt == "":
+				case opt == "deprecated":
+					field.deprecated = true
+				case opt == "inline":
+					inline = true
+				case opt == "json":
+					field.json = true
+				case key == "pos" && hasValue, !hasValue && isDigits(key):
+					if !hasValue {
+						value = key
+					}
+					n, err := strconv.Atoi(value)
+					if err != nil || !isDigits(value) {
+						return 0, fmt.Errorf("ido: struct field %s.%s: invalid position %q", t, f.Name, value)
+					}
+					pos = base + n
+				case key == "name" && hasValue && value != "":
+					field.label = value
+				default:
+					return 0, fmt.Errorf("ido: struct field %s.%s: unknown tag option %q", t, f.Name, opt)
+				}
+			}
+		}
+		if field.deprecated {
+			field.index = nil
+		}
+
+		// Unexported fields cannot be set through reflection, so they are
+		// skipped unless their tag asks for them, which is an error. The
+		// exception is an embedded struct inlined by value: its exported
+		// fields remain settable.
+		if !f.IsExported() && !field.deprecated {
+			switch {
+			case inline && f.Anonymous && f.Type.Kind() == reflect.Struct:
+			case !ok || tag == "":
+				continue
+			default:
+				return 0, fmt.Errorf("ido: struct field %s.%s: cannot encode unexported field", t, f.Name)
+			}
+		}
+
+		if inline && field.json {
+			return 0, fmt.Errorf("ido: struct field %s.%s: inline and json cannot be combined", t, f.Name)
+		}
+		if inline && !field.deprecated {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct || ft == timeType {
+				return 0, fmt.Errorf("ido: struct field %s.%s: cannot inline non-struct type %s", t, f.Name, f.Type)
+			}
+			if len(index) > maxInlineDepth {
+				return 0, fmt.Errorf("ido: struct field %s.%s: inlined structs nested too deeply", t, f.Name)
+			}
+			next, err := layoutFields(slots, root, ft, pos, field.index)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+			continue
+		}
+
+		for len(*slots) <= pos {
+			*slots = append(*slots, structField{})
+		}
+		if prev := (*slots)[pos]; prev.name != "" {
+			return 0, fmt.Errorf("ido: struct %s: fields %s and %s both use position %d", root, prev.name, f.Name, pos)
+		}
+		(*slots)[pos] = field
+		pos++
+	}
+	return pos, nil
+}
+
+// maxInlineDepth bounds the nesting of inlined structs, which would
+// otherwise recurse forever on a struct that inlines itself through a
+// pointer.
+const maxInlineDepth = 32
+
+// fieldByIndex returns the field of struct v at index. Nil pointers to
+// inlined structs met on the way are allocated if alloc is set; otherwise
+// ok is false.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (f reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
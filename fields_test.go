@@ -0,0 +1,302 @@
+package ido
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFieldPositions(t *testing.T) {
+	type user struct {
+		ID    int    `ido:"0"`
+		Email string `ido:"pos=2,name=email"`
+		Name  string // position 3, after Email
+		Skip  int    `ido:"-"`
+	}
+	slots, err := structFields(reflect.TypeOf(user{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, f := range slots {
+		labels = append(labels, f.label)
+	}
+	if want := []string{"ID", "", "email", "Name"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("slots = %q, want %q", labels, want)
+	}
+
+	in := user{ID: 1, Email: "a@b", Name: "n", Skip: 9}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{1,,"a@b","n"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out user
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if in.Skip = 0; out != in {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+
+	// A value in a hole is an error in strict mode.
+	if err := Unmarshal([]byte(`{1,5,"a@b","n"}`), &out); err == nil {
+		t.Errorf("Unmarshal with a value in a hole succeeded")
+	}
+}
+
+func TestFieldPositionsOutOfOrder(t *testing.T) {
+	type reordered struct {
+		C string `ido:"2"`
+		A string `ido:"0"`
+		B string
+	}
+	data, err := Marshal(reordered{C: "c", A: "a", B: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a","b","c"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	data, _ = MarshalAnnotated(reordered{}, "", "")
+	if !strings.Contains(string(data), "// A") || !strings.Contains(string(data), "// C") {
+		t.Errorf("MarshalAnnotated = %s, want labels for every field", data)
+	}
+}
+
+func TestFieldTagErrors(t *testing.T) {
+	for _, tt := range []struct {
+		v    any
+		want string
+	}{
+		{struct {
+			A int `ido:"1"`
+			B int `ido:"1"`
+		}{}, "fields A and B both use position 1"},
+		{struct {
+			A int
+			B int `ido:"0"`
+		}{}, "fields A and B both use position 0"},
+		{struct {
+			A int `ido:"pos=-1"`
+		}{}, `invalid position "-1"`},
+		{struct {
+			A int `ido:"pos=x"`
+		}{}, `invalid position "x"`},
+		{struct {
+			A int `ido:"1,color"`
+		}{}, `unknown tag option "color"`},
+		{struct {
+			A int `ido:"name="`
+		}{}, `unknown tag option "name="`},
+	} {
+		_, err := Marshal(tt.v)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Marshal(%T) = %v, want error containing %q", tt.v, err, tt.want)
+		}
+		if err := Unmarshal([]byte("{}"), reflect.New(reflect.TypeOf(tt.v)).Interface()); err == nil {
+			t.Errorf("Unmarshal into %T succeeded, want tag error", tt.v)
+		}
+	}
+}
+
+// Meta and Base are exported so that pointers to them can be allocated
+// through the embedding structs.
+type Meta struct {
+	Created int
+	Tags    []string
+}
+
+type inlineDoc struct {
+	ID    int
+	*Meta `ido:",inline"`
+	Title string
+}
+
+type Base struct {
+	Rev  int
+	Kind string `ido:"2"` // counted from the inlined struct's position
+}
+
+type inlinePositioned struct {
+	Name string `ido:"0"`
+	Base `ido:"2,inline"`
+	Note string
+}
+
+func TestInline(t *testing.T) {
+	in := inlineDoc{ID: 1, Meta: &Meta{Created: 5, Tags: []string{"a"}}, Title: "t"}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{1,5,["a"],"t"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out inlineDoc
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestInlineNilPointer(t *testing.T) {
+	// A nil inlined pointer is written as empty slots.
+	data, err := Marshal(inlineDoc{ID: 1, Title: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{1,,,"t"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+
+	// Decoding leaves it nil while its slots are empty or null...
+	var out inlineDoc
+	for _, in := range []string{`{1,,,"t"}`, `{1,~,~,"t"}`} {
+		if err := Unmarshal([]byte(in), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Meta != nil {
+			t.Errorf("Unmarshal(%s): inlined pointer = %+v, want nil", in, out.Meta)
+		}
+	}
+
+	// ...and allocates it for the first value it holds.
+	if err := Unmarshal([]byte(`{1,,["x"],"t"}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Meta{Tags: []string{"x"}}); !reflect.DeepEqual(out.Meta, want) {
+		t.Errorf("Unmarshal: inlined pointer = %+v, want %+v", out.Meta, want)
+	}
+}
+
+func TestInlinePositions(t *testing.T) {
+	slots, err := structFields(reflect.TypeOf(inlinePositioned{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, f := range slots {
+		labels = append(labels, f.label)
+	}
+	if want := []string{"Name", "", "Rev", "", "Kind", "Note"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("slots = %q, want %q", labels, want)
+	}
+
+	in := inlinePositioned{Name: "n", Base: Base{Kind: "k", Rev: 2}, Note: "x"}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"n",,2,,"k","x"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out inlinePositioned
+	if err := Unmarshal(data, &out); err != nil || out != in {
+		t.Errorf("Unmarshal(%s) = %+v, %v; want %+v", data, out, err, in)
+	}
+
+	// Errors in inlined fields carry their offset in the parent record.
+	var terr *UnmarshalTypeError
+	bad := `{"n",,"2",,"k","x"}`
+	if err := Unmarshal([]byte(bad), &out); !errors.As(err, &terr) || terr.Field != "Rev" || terr.Offset != 6 {
+		t.Errorf("Unmarshal(%s) = %v, want *UnmarshalTypeError for Rev at offset 6", bad, err)
+	}
+}
+
+func TestInlineErrors(t *testing.T) {
+	type Loop struct {
+		*Loop `ido:",inline"`
+	}
+	for _, tt := range []struct {
+		v    any
+		want string
+	}{
+		{struct {
+			N int `ido:",inline"`
+		}{}, "cannot inline non-struct type int"},
+		{struct {
+			M Meta `ido:",inline,json"`
+		}{}, "inline and json cannot be combined"},
+		{struct {
+			A int
+			B Meta `ido:"0,inline"`
+		}{}, "fields A and Created both use position 0"},
+		{Loop{}, "inlined structs nested too deeply"},
+	} {
+		_, err := Marshal(tt.v)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Marshal(%T) = %v, want error containing %q", tt.v, err, tt.want)
+		}
+	}
+}
+
+type hidden struct {
+	Exported string
+}
+
+func TestUnexportedFields(t *testing.T) {
+	type record struct {
+		A      int
+		secret string // skipped: takes no slot
+		B      int
+		hidden `ido:",inline"` // inlined by value: its exported fields are kept
+	}
+	in := record{A: 1, secret: "s", B: 2, hidden: hidden{"e"}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{1,2,"e"}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	out := record{secret: "kept"}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := (record{A: 1, secret: "kept", B: 2, hidden: hidden{"e"}}); out != want {
+		t.Errorf("Unmarshal(%s) = %+v, want %+v", data, out, want)
+	}
+}
+
+func TestUnexportedFieldTagged(t *testing.T) {
+	for _, v := range []any{
+		struct {
+			a int `ido:"0"`
+		}{},
+		struct {
+			A int
+			b int `ido:",json"`
+		}{},
+		struct {
+			*hidden `ido:",inline"` // a nil pointer could not be allocated
+		}{},
+		struct {
+			hidden `ido:"name=h"` // not inlined: the struct itself is unexported
+		}{},
+	} {
+		const want = "cannot encode unexported field"
+		if _, err := Marshal(v); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Marshal(%T) = %v, want error containing %q", v, err, want)
+		}
+		if err := Unmarshal([]byte("{}"), reflect.New(reflect.TypeOf(v)).Interface()); err == nil {
+			t.Errorf("Unmarshal into %T succeeded, want tag error", v)
+		}
+	}
+
+	// An unexported field may be tagged "-" or reserve its slot as deprecated.
+	type record struct {
+		A int
+		b int `ido:"-"`
+		c int `ido:",deprecated"`
+		D int
+	}
+	if data, err := Marshal(record{A: 1, b: 2, c: 3, D: 4}); err != nil || string(data) != "{1,,4}" {
+		t.Errorf("Marshal = %s, %v; want {1,,4}", data, err)
+	}
+}
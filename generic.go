@@ -0,0 +1,201 @@
+package ido
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// ---------------------------------------------------------
+// GENERIC VALUES
+// ---------------------------------------------------------
+
+// Number is an IDO numeric literal, kept as text so no precision is lost.
+// Decoding into an empty interface produces Numbers for numeric values.
+type Number string
+
+// String returns the literal text of the number.
+func (n Number) String() string { return string(n) }
+
+// Float64 returns the number as a float64.
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Int64 returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+func decodeAnyValue(s *decodeState, d []byte, v reflect.Value) error {
+	val, err := decodeAny(s, d)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		v.SetZero()
+		return nil
+	}
+	v.Set(reflect.ValueOf(val))
+	return nil
+}
+
+// decodeAny decodes a token without a target type. Objects and arrays
+// become []any, maps map[string]any, quoted values string, numerics Number,
+// '+' and '-' true and false, and empty slots and '~' nil. Tagged values of
+// a registered type decode into that type; unknown tags fall back to the
+// generic form of the value.
+func decodeAny(s *decodeState, d []byte) (any, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+
+	switch d[0] {
+	case '"':
+		if len(d) < 2 || d[len(d)-1] != '"' {
+			return nil, s.syntaxError(d, "unterminated string", `"`)
+		}
+		return unescape(s, d[1:len(d)-1])
+	case '{', '[':
+		return decodeAnyList(s, d)
+	case '<':
+		return decodeAnyMap(s, d)
+	case 'b':
+		return decodeBase64(s, d)
+	case '@':
+		name, value, ok := splitTypeTag(d)
+		if !ok {
+			return nil, s.syntaxError(d, "malformed type tag", "@name:")
+		}
+		if rt, ok := registeredType(unsafeString(name)); ok {
+			elem, err := decodeRegistered(s, rt, value)
+			if err != nil {
+				return nil, err
+			}
+			return elem.Interface(), nil
+		}
+		return decodeAny(s, value)
+	case '+':
+		if len(d) == 1 {
+			return true, nil
+		}
+	case '-':
+		if len(d) == 1 {
+			return false, nil
+		}
+	case '~':
+		if len(d) == 1 {
+			return nil, nil
+		}
+	}
+
+	if !isNumber(d) && !isNonFinite(d) {
+		return nil, s.syntaxError(d, "invalid value "+strconv.Quote(string(d)), "value")
+	}
+	return Number(d), nil
+}
+
+func decodeAnyList(s *decodeState, d []byte) (any, error) {
+	if len(d) < 2 {
+		return nil, s.syntaxError(d, "unterminated value", string(closing(d[0])))
+	}
+	content := trimSpace(d[1 : len(d)-1])
+
+	list := []any{}
+	for more := len(content) > 0; more; {
+		var token []byte
+		token, content, more = nextToken(content)
+
+		val, err := decodeAny(s, token)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, val)
+	}
+	return list, nil
+}
+
+func decodeAnyMap(s *decodeState, d []byte) (any, error) {
+	if len(d) < 2 {
+		return nil, s.syntaxError(d, "unterminated value", string(closing(d[0])))
+	}
+	content := trimSpace(d[1 : len(d)-1])
+
+	m := make(map[string]any)
+	for more := len(content) > 0; more; {
+		var token []byte
+		token, content, more = nextToken(content)
+
+		if len(token) > 0 {
+			keyToken, valToken, ok := splitMapEntry(token)
+			if !ok {
+				return nil, s.syntaxError(token, "map entry without key", ":")
+			}
+			if len(keyToken) == 0 || keyToken[0] != '"' && !isNumber(keyToken) {
+				return nil, s.syntaxError(token, "invalid map key", "string or number")
+			}
+			key := string(keyToken)
+			if len(keyToken) >= 2 && keyToken[0] == '"' {
+				var err error
+				if key, err = unescape(s, keyToken[1:len(keyToken)-1]); err != nil {
+					return nil, err
+				}
+			}
+			val, err := decodeAny(s, valToken)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = val
+		}
+	}
+	return m, nil
+}
+
+// isNonFinite reports whether b is one of the float literals NaN, Inf and
+// -Inf.
+func isNonFinite(b []byte) bool {
+	switch string(b) {
+	case "NaN", "Inf", "-Inf":
+		return true
+	}
+	return false
+}
+
+// isNumber reports whether b is a decimal number literal:
+// an optional '-', digits, an optional fraction and an optional exponent.
+func isNumber(b []byte) bool {
+	i := 0
+	if i < len(b) && b[i] == '-' {
+		i++
+	}
+	start := i
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	if i == start {
+		return false
+	}
+	if i < len(b) && b[i] == '.' {
+		i++
+		start = i
+		for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			i++
+		}
+		start = i
+		for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+			i++
+		}
+		if i == start {
+			return false
+		}
+	}
+	return i == len(b)
+}
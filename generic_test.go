@@ -0,0 +1,118 @@
+package ido
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAny(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want any
+	}{
+		{``, nil},
+		{`~`, nil},
+		{`+`, true},
+		{`-`, false},
+		{`"a\nb"`, "a\nb"},
+		{`12`, Number("12")},
+		{`-1.5e300`, Number("-1.5e300")},
+		{`NaN`, Number("NaN")},
+		{`b"AQI="`, []byte{1, 2}},
+		{`{}`, []any{}},
+		{`[]`, []any{}},
+		{`{,}`, []any{nil, nil}},
+		{`{"John",,30,~}`, []any{"John", nil, Number("30"), nil}},
+		{`[1,[2,{+}]]`, []any{Number("1"), []any{Number("2"), []any{true}}}},
+		{`<>`, map[string]any{}},
+		{`<"a":1,2:[-],"c":>`, map[string]any{"a": Number("1"), "2": []any{false}, "c": nil}},
+		{"{ \"a\" ,\n [ 1 ] // note\n}", []any{"a", []any{Number("1")}}},
+		{`@test.circle:{2}`, circle{2}},
+		{`@unknown.type:{2}`, []any{Number("2")}},
+	} {
+		var v any
+		if err := Unmarshal([]byte(tt.in), &v); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, v, tt.want)
+		}
+	}
+}
+
+func TestDecodeAnyReplaces(t *testing.T) {
+	// A value already in the interface does not guide decoding.
+	var v any = map[string]int{"a": 1}
+	if err := Unmarshal([]byte(`<"a":2>`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"a": Number("2")}; !reflect.DeepEqual(v, want) {
+		t.Errorf("Unmarshal = %#v, want %#v", v, want)
+	}
+
+	// ~ clears a struct field of interface type.
+	var rec struct{ A, B any }
+	rec.B = "old"
+	if err := Unmarshal([]byte(`{[1],~}`), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec.A, []any{Number("1")}) || rec.B != nil {
+		t.Errorf("Unmarshal = %#v, want A [1] and B nil", rec)
+	}
+}
+
+func TestDecodeAnyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		offset int64
+	}{
+		{`yes`, 0},
+		{`{1,"a}`, 3},
+		{`<a:1>`, 1},
+		{`<:1>`, 1},
+		{`["\q"]`, 2},
+		{`{1 2}`, 1},
+	} {
+		var v any
+		var serr *SyntaxError
+		if err := Unmarshal([]byte(tt.in), &v); !errors.As(err, &serr) || serr.Offset != tt.offset {
+			t.Errorf("Unmarshal(%s) = %#v, %v; want *SyntaxError at offset %d", tt.in, v, err, tt.offset)
+		}
+	}
+}
+
+func TestNumber(t *testing.T) {
+	n := Number("-42")
+	if i, err := n.Int64(); err != nil || i != -42 {
+		t.Errorf("Int64() = %d, %v; want -42", i, err)
+	}
+	if f, err := n.Float64(); err != nil || f != -42 {
+		t.Errorf("Float64() = %g, %v; want -42", f, err)
+	}
+	if n.String() != "-42" {
+		t.Errorf("String() = %q, want %q", n.String(), "-42")
+	}
+
+	n = "1.5e3"
+	if _, err := n.Int64(); err == nil {
+		t.Errorf("Number(%q).Int64() succeeded, want error", n)
+	}
+	if f, err := n.Float64(); err != nil || f != 1500 {
+		t.Errorf("Number(%q).Float64() = %g, %v; want 1500", n, f, err)
+	}
+	if f, err := Number("-Inf").Float64(); err != nil || !math.IsInf(f, -1) {
+		t.Errorf("Number(-Inf).Float64() = %g, %v; want -Inf", f, err)
+	}
+
+	// A number too large for int64 keeps its digits.
+	var v any
+	if err := Unmarshal([]byte(`123456789012345678901234567890`), &v); err != nil || v != Number("123456789012345678901234567890") {
+		t.Errorf("Unmarshal(big number) = %#v, %v", v, err)
+	}
+	if _, err := v.(Number).Int64(); err == nil {
+		t.Errorf("Int64() of a 30-digit number succeeded, want range error")
+	}
+}
@@ -0,0 +1,188 @@
+package ido
+
+import "bytes"
+
+// ---------------------------------------------------------
+// FORMATTING
+// ---------------------------------------------------------
+
+// MarshalIndent is like Marshal but applies Indent to format the output.
+func MarshalIndent(v any, prefix, indent string) ([]byte, error) {
+	return MarshalOptions{}.MarshalIndent(v, prefix, indent)
+}
+
+// MarshalIndent is like the package-level MarshalIndent but applies the
+// options in o.
+func (o MarshalOptions) MarshalIndent(v any, prefix, indent string) ([]byte, error) {
+	b, err := o.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(b) * 2)
+	if err := Indent(&buf, b, prefix, indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalAnnotated is like MarshalIndent but follows every struct field with
+// a // FieldName comment, so the output can be read without the Go type at
+// hand. The decoder ignores comments, so annotated output stays loadable.
+func MarshalAnnotated(v any, prefix, indent string) ([]byte, error) {
+	e := newEncodeState()
+	defer statePool.Put(e)
+
+	e.annotate = true
+	if err := e.marshal(v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(e.buf) * 2)
+	if err := Indent(&buf, e.buf, prefix, indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compact appends to dst the IDO-encoded src with insignificant whitespace
+// removed. Input that is not well-formed is reported as a *SyntaxError and
+// nothing is appended, since dropping the space inside a malformed token
+// could turn it into a different, valid one.
+func Compact(dst *bytes.Buffer, src []byte) error {
+	if err := checkValid(&decodeState{data: src}); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case isSpace(c):
+		case isComment(src, i):
+			i = commentEnd(src, i) - 1
+		case c == '"':
+			end := i + stringEnd(src[i:])
+			dst.Write(src[i:end])
+			i = end - 1
+		default:
+			dst.WriteByte(c)
+		}
+	}
+	return nil
+}
+
+// Indent appends to dst an indented form of the IDO-encoded src. Every
+// value of a struct, slice or map begins on a new line starting with prefix
+// followed by one copy of indent per level of nesting. The data appended to
+// dst does not begin with the prefix nor any indentation, and empty
+// containers stay on one line. Comments are kept at the end of the line of
+// the value they follow. Like Compact, Indent rejects input that is not
+// well-formed with a *SyntaxError.
+func Indent(dst *bytes.Buffer, src []byte, prefix, indent string) error {
+	if err := checkValid(&decodeState{data: src}); err != nil {
+		return err
+	}
+
+	depth := 0
+	needIndent := false
+	inTag := false
+
+	writeIndent := func() {
+		if !needIndent {
+			return
+		}
+		dst.WriteString(prefix)
+		for i := 0; i < depth; i++ {
+			dst.WriteString(indent)
+		}
+		needIndent = false
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		case '"':
+			writeIndent()
+			end := i + stringEnd(src[i:])
+			dst.Write(src[i:end])
+			i = end - 1
+		case '{', '[', '<':
+			writeIndent()
+			dst.WriteByte(c)
+
+			j := i + 1
+			for j < len(src) && isSpace(src[j]) {
+				j++
+			}
+			if j < len(src) && src[j] == closing(c) {
+				dst.WriteByte(src[j])
+				i = j
+				continue
+			}
+
+			depth++
+			dst.WriteByte('\n')
+			needIndent = true
+		case '}', ']', '>':
+			depth--
+			if !needIndent {
+				dst.WriteByte('\n')
+				needIndent = true
+			}
+			writeIndent()
+			dst.WriteByte(c)
+		case ',':
+			writeIndent()
+			dst.WriteByte(',')
+
+			// A comment on the same line stays attached to the value.
+			j := i + 1
+			for j < len(src) && (src[j] == ' ' || src[j] == '\t') {
+				j++
+			}
+			if j < len(src) && isComment(src, j) {
+				i = writeComment(dst, src, j) - 1
+			}
+			dst.WriteByte('\n')
+			needIndent = true
+		case '/':
+			if !isComment(src, i) {
+				writeIndent()
+				dst.WriteByte(c)
+				continue
+			}
+			writeIndent()
+			i = writeComment(dst, src, i) - 1
+			dst.WriteByte('\n')
+			needIndent = true
+		case ':':
+			// Map entries read "key": value; type tags stay @name:value.
+			dst.WriteByte(':')
+			if !inTag {
+				dst.WriteByte(' ')
+			}
+			inTag = false
+		case '@':
+			writeIndent()
+			dst.WriteByte(c)
+			inTag = true
+		default:
+			writeIndent()
+			dst.WriteByte(c)
+		}
+	}
+	return nil
+}
+
+// writeComment writes the comment starting at src[i], preceded by a space
+// when it follows a value, and returns the index of the newline ending it.
+func writeComment(dst *bytes.Buffer, src []byte, i int) int {
+	end := commentEnd(src, i)
+	if b := dst.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' && !isSpace(b[len(b)-1]) {
+		dst.WriteByte(' ')
+	}
+	dst.Write(bytes.TrimRight(src[i:end], " \t\r"))
+	return end
+}
@@ -0,0 +1,221 @@
+package ido
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type indentBank struct {
+	Location string
+	Money    float64
+	Accounts int64
+	Country  string
+}
+
+type indentPerson struct {
+	Name     string
+	LastName string
+	Age      int
+	Bank     indentBank
+}
+
+var indentSample = indentPerson{"John", "Doe", 30, indentBank{"Santander", 10000000, 100, "Spain"}}
+
+func TestMarshalIndent(t *testing.T) {
+	got, err := MarshalIndent(indentSample, "", "    ")
+	if err != nil {
+		t.Fatalf("MarshalIndent: %v", err)
+	}
+	want := `{
+    "John",
+    "Doe",
+    30,
+    {
+        "Santander",
+        1e7,
+        100,
+        "Spain"
+    }
+}`
+	if string(got) != want {
+		t.Errorf("MarshalIndent =\n%s\nwant\n%s", got, want)
+	}
+
+	var out indentPerson
+	if err := Unmarshal(got, &out); err != nil || out != indentSample {
+		t.Errorf("Unmarshal(MarshalIndent) = %+v, %v; want %+v", out, err, indentSample)
+	}
+}
+
+func TestIndentCompactRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		`{"John",,30,{"a, b",[],<>}}`,
+		`[1,[2,[3]],""]`,
+		`<"a":1,"b":[+,-,~]>`,
+		`{@test.circle:{2},b"aGk="}`,
+		`"plain"`,
+		`-1.5e300`,
+	} {
+		var indented, compact bytes.Buffer
+		if err := Indent(&indented, []byte(in), "", "\t"); err != nil {
+			t.Errorf("Indent(%s): %v", in, err)
+			continue
+		}
+		if err := Compact(&compact, indented.Bytes()); err != nil {
+			t.Errorf("Compact(%s): %v", indented.Bytes(), err)
+			continue
+		}
+		if compact.String() != in {
+			t.Errorf("Compact(Indent(%s)) = %s", in, compact.Bytes())
+		}
+	}
+}
+
+func TestIndentLayout(t *testing.T) {
+	var buf bytes.Buffer
+	in := `{<"k":@test.circle:{1}>,[]}`
+	if err := Indent(&buf, []byte(in), "", "  "); err != nil {
+		t.Fatalf("Indent: %v", err)
+	}
+	want := `{
+  <
+    "k": @test.circle:{
+      1
+    }
+  >,
+  []
+}`
+	if buf.String() != want {
+		t.Errorf("Indent(%s) =\n%s\nwant\n%s", in, buf.Bytes(), want)
+	}
+}
+
+func TestCompactIndentRejectInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		offset int64
+	}{
+		{"{1 2}", 3},
+		{"[a b]", 1},
+		{"@aa :{0}", 0},
+		{`{"a" "b"}`, 5},
+		{"{1,2", 4},
+	} {
+		for name, f := range map[string]func(*bytes.Buffer, []byte) error{
+			"Compact": Compact,
+			"Indent":  func(dst *bytes.Buffer, src []byte) error { return Indent(dst, src, "", "  ") },
+		} {
+			var buf bytes.Buffer
+			err := f(&buf, []byte(tt.in))
+			var serr *SyntaxError
+			if !errors.As(err, &serr) || serr.Offset != tt.offset {
+				t.Errorf("%s(%q) = %v, want *SyntaxError at offset %d", name, tt.in, err, tt.offset)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%s(%q) wrote %q on error", name, tt.in, buf.Bytes())
+			}
+		}
+	}
+}
+
+func TestEncoderSetIndent(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	for _, v := range []indentPerson{indentSample, {Name: "Jane"}} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range []indentPerson{indentSample, {Name: "Jane"}} {
+		var got indentPerson
+		if err := dec.Decode(&got); err != nil || got != want {
+			t.Errorf("Decode = %+v, %v; want %+v", got, err, want)
+		}
+	}
+}
+
+func TestMarshalAnnotated(t *testing.T) {
+	got, err := MarshalAnnotated(indentSample, "", "    ")
+	if err != nil {
+		t.Fatalf("MarshalAnnotated: %v", err)
+	}
+	want := `{
+    "John", // Name
+    "Doe", // LastName
+    30, // Age
+    {
+        "Santander", // Location
+        1e7, // Money
+        100, // Accounts
+        "Spain" // Country
+    } // Bank
+}`
+	if string(got) != want {
+		t.Errorf("MarshalAnnotated =\n%s\nwant\n%s", got, want)
+	}
+
+	var out indentPerson
+	if err := Unmarshal(got, &out); err != nil || out != indentSample {
+		t.Errorf("Unmarshal(MarshalAnnotated) = %+v, %v; want %+v", out, err, indentSample)
+	}
+	var buf bytes.Buffer
+	if err := Compact(&buf, got); err != nil || buf.String() != `{"John","Doe",30,{"Santander",1e7,100,"Spain"}}` {
+		t.Errorf("Compact(MarshalAnnotated) = %s, %v", buf.Bytes(), err)
+	}
+}
+
+func TestMarshalAnnotatedLabels(t *testing.T) {
+	type item struct {
+		ID    int    `ido:"name=id"`
+		Empty string // zero: an empty slot keeps its label
+		Tags  []string
+	}
+	got, err := MarshalAnnotated([]item{{ID: 1, Tags: []string{"a"}}}, "", "  ")
+	if err != nil {
+		t.Fatalf("MarshalAnnotated: %v", err)
+	}
+	want := `[
+  {
+    1, // id
+    , // Empty
+    [
+      "a"
+    ] // Tags
+  }
+]`
+	if string(got) != want {
+		t.Errorf("MarshalAnnotated =\n%s\nwant\n%s", got, want)
+	}
+	var out []item
+	if err := Unmarshal(got, &out); err != nil || len(out) != 1 || out[0].ID != 1 || out[0].Tags[0] != "a" {
+		t.Errorf("Unmarshal(MarshalAnnotated) = %+v, %v", out, err)
+	}
+}
+
+func TestCommentsIgnored(t *testing.T) {
+	for _, in := range []string{
+		"// leading\n{\"a\", // x\n 1 // y\n} // trailing",
+		"{\"a\",1}//no space",
+		"{\"a // not a comment\",1}",
+		"{\"a\",\n// a whole line\n1}",
+	} {
+		var v struct {
+			S string
+			N int
+		}
+		if err := Unmarshal([]byte(in), &v); err != nil || v.N != 1 || !bytes.HasPrefix([]byte(v.S), []byte("a")) {
+			t.Errorf("Unmarshal(%q) = %+v, %v", in, v, err)
+		}
+		if !Valid([]byte(in)) {
+			t.Errorf("Valid(%q) = false, want true", in)
+		}
+	}
+	var s string
+	if err := Unmarshal([]byte(`"a // b"`), &s); err != nil || s != "a // b" {
+		t.Errorf("Unmarshal = %q, %v; want comment marker kept inside a string", s, err)
+	}
+}
@@ -0,0 +1,77 @@
+package ido
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// ---------------------------------------------------------
+// TYPE REGISTRY
+// ---------------------------------------------------------
+
+var (
+	registryMu sync.RWMutex
+	nameToType = make(map[string]reflect.Type)
+	typeToName = make(map[reflect.Type]string)
+)
+
+// Register records the concrete type of sample under name. Interface values
+// holding a registered type are encoded as @name:value, which lets the
+// decoder rebuild the same concrete type.
+//
+// Names may contain letters, digits, '_', '.' and '-'. Register panics if
+// name is invalid, or if name or the type is already registered differently.
+func Register(name string, sample any) {
+	if !validTypeName(name) {
+		panic("ido: invalid type name " + strconv.Quote(name))
+	}
+	if sample == nil {
+		panic("ido: Register of nil sample")
+	}
+	t := reflect.TypeOf(sample)
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if old, ok := nameToType[name]; ok && old != t {
+		panic(fmt.Sprintf("ido: registering duplicate types for %q: %s != %s", name, old, t))
+	}
+	if old, ok := typeToName[t]; ok && old != name {
+		panic(fmt.Sprintf("ido: registering duplicate names for %s: %q != %q", t, old, name))
+	}
+	nameToType[name] = t
+	typeToName[t] = name
+}
+
+func registeredName(t reflect.Type) (string, bool) {
+	registryMu.RLock()
+	name, ok := typeToName[t]
+	registryMu.RUnlock()
+	return name, ok
+}
+
+func registeredType(name string) (reflect.Type, bool) {
+	registryMu.RLock()
+	t, ok := nameToType[name]
+	registryMu.RUnlock()
+	return t, ok
+}
+
+func validTypeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTypeNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTypeNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '-'
+}
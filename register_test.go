@@ -0,0 +1,127 @@
+package ido
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type shape interface{ area() float64 }
+
+type circle struct{ R float64 }
+
+func (c circle) area() float64 { return 3 * c.R * c.R }
+
+type square struct{ S float64 }
+
+func (s *square) area() float64 { return s.S * s.S }
+
+type unregisteredShape struct{ N int }
+
+func (unregisteredShape) area() float64 { return 0 }
+
+type notAShape struct{ N int }
+
+func init() {
+	Register("test.circle", circle{})
+	Register("test.square", &square{})
+	Register("test.notAShape", notAShape{})
+}
+
+func TestInterfaceRoundTrip(t *testing.T) {
+	type envelope struct {
+		Shapes []shape
+		Any    any
+		Nil    shape
+	}
+	in := envelope{
+		Shapes: []shape{circle{2}, &square{3}},
+		Any:    circle{1},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := `{[@test.circle:{2},@test.square:{3}],@test.circle:{1},}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var out envelope
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %#v, want %#v", out, in)
+	}
+}
+
+func TestInterfaceUnregistered(t *testing.T) {
+	var s struct{ S shape }
+	s.S = unregisteredShape{1}
+	if data, err := Marshal(s); err == nil {
+		t.Errorf("Marshal(unregistered type in shape) = %s, want error", data)
+	}
+
+	// An empty interface takes untagged values in their generic form.
+	data, err := Marshal(struct{ A any }{unregisteredShape{1}})
+	if err != nil {
+		t.Fatalf("Marshal(unregistered type in any): %v", err)
+	}
+	var a struct{ A any }
+	if err := Unmarshal(data, &a); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if want := []any{Number("1")}; !reflect.DeepEqual(a.A, want) {
+		t.Errorf("A = %#v, want %#v", a.A, want)
+	}
+}
+
+func TestInterfaceDecodeErrors(t *testing.T) {
+	for _, in := range []string{
+		`{@test.notAShape:{1}}`, // registered, but not a shape
+		`{@test.unknown:{1}}`,   // not registered
+		`{{1}}`,                 // untagged
+	} {
+		var s struct{ S shape }
+		var terr *UnmarshalTypeError
+		if err := Unmarshal([]byte(in), &s); !errors.As(err, &terr) || terr.Field != "S" {
+			t.Errorf("Unmarshal(%s) = %v, want *UnmarshalTypeError for field S", in, err)
+		}
+	}
+
+	var serr *SyntaxError
+	var s struct{ S shape }
+	if err := Unmarshal([]byte(`{@bad name:{1}}`), &s); !errors.As(err, &serr) || serr.Offset != 1 {
+		t.Errorf("Unmarshal(malformed tag) = %v, want *SyntaxError at offset 1", err)
+	}
+
+	// An unknown tag in an empty interface falls back to the generic form.
+	var a any
+	if err := Unmarshal([]byte(`@test.unknown:[1,"x"]`), &a); err != nil {
+		t.Fatalf("Unmarshal(unknown tag into any): %v", err)
+	}
+	if want := []any{Number("1"), "x"}; !reflect.DeepEqual(a, want) {
+		t.Errorf("unknown tag into any = %#v, want %#v", a, want)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for name, f := range map[string]func(){
+		"invalid name":   func() { Register("bad name", circle{}) },
+		"empty name":     func() { Register("", circle{}) },
+		"nil sample":     func() { Register("test.nil", nil) },
+		"duplicate name": func() { Register("test.circle", notAShape{}) },
+		"duplicate type": func() { Register("test.circle2", circle{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: Register did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+
+	// Registering the same pair again is allowed.
+	Register("test.circle", circle{})
+}
@@ -0,0 +1,262 @@
+package ido
+
+import "strconv"
+
+// ---------------------------------------------------------
+// VALIDATION
+// ---------------------------------------------------------
+
+// Valid reports whether data is a well-formed IDO value. It checks syntax
+// only and allocates nothing for the decoded value.
+func Valid(data []byte) bool {
+	return Validate(data) == nil
+}
+
+// Validate checks that data is a well-formed IDO value without decoding it.
+// The first problem found is returned as a *SyntaxError with its offset.
+func Validate(data []byte) error {
+	return checkValid(&decodeState{data: data})
+}
+
+// Validate reads the next record from the stream and checks that it is
+// well-formed without decoding it. The first problem found is returned as
+// a *SyntaxError whose offset is relative to the whole stream.
+func (d *Decoder) Validate() error {
+	token, start, err := d.nextRecord()
+	if err != nil {
+		return err
+	}
+	return checkValid(&decodeState{data: token, base: start})
+}
+
+// maxDepth bounds the nesting of containers and type tags, so that hostile
+// input is rejected before it can make validation or decoding recurse
+// deeply.
+const maxDepth = 10000
+
+// checkValid validates s.data in a single pass: brackets and quotes, the
+// lexical form of every value, and that nothing follows the top-level
+// value. An empty record is valid.
+func checkValid(s *decodeState) error {
+	v := validator{s: s, data: s.data}
+	v.skipSpace()
+	start := v.i
+	if err := v.value(); err != nil {
+		return err
+	}
+	v.skipSpace()
+	switch {
+	case v.i == len(v.data):
+		return nil
+	case v.i == start:
+		return s.syntaxError(v.data[v.i:], "unexpected "+strconv.QuoteRune(rune(v.data[v.i])), "value")
+	}
+	return s.syntaxError(v.data[v.i:], "trailing data after top-level value", "end of input")
+}
+
+// validator scans data from i on, one value at a time.
+type validator struct {
+	s     *decodeState
+	data  []byte
+	i     int
+	depth int
+}
+
+func (v *validator) skipSpace() {
+	v.i += skipSpace(v.data[v.i:])
+}
+
+// value checks the value at v.i, which may be empty as in an empty slot,
+// and moves past it.
+func (v *validator) value() error {
+	if v.i == len(v.data) {
+		return nil
+	}
+	switch c := v.data[v.i]; c {
+	case ',', '}', ']', '>':
+		return nil
+	case '{', '[', '<':
+		return v.container(c)
+	case '"':
+		return v.str()
+	case '@':
+		return v.tag()
+	case 'b':
+		if v.i+1 < len(v.data) && v.data[v.i+1] == '"' {
+			return v.bytes()
+		}
+	}
+
+	start := v.i
+	d := v.scalar()
+	switch {
+	case len(d) == 0:
+		return v.s.syntaxError(v.data[start:], "unexpected "+strconv.QuoteRune(rune(v.data[start])), "value")
+	case len(d) == 1 && (d[0] == '+' || d[0] == '-' || d[0] == '~'):
+	case !isNumber(d) && !isNonFinite(d):
+		return v.s.syntaxError(d, "invalid value "+strconv.Quote(string(d)), "value")
+	}
+	return nil
+}
+
+// scalar returns the bare token at v.i and moves past it. The token ends at
+// whitespace, a comment or a delimiter.
+func (v *validator) scalar() []byte {
+	start := v.i
+	for ; v.i < len(v.data); v.i++ {
+		switch v.data[v.i] {
+		case ' ', '\t', '\r', '\n', ',', ':', '{', '}', '[', ']', '<', '>', '"', '@':
+			return v.data[start:v.i]
+		case '/':
+			if isComment(v.data, v.i) {
+				return v.data[start:v.i]
+			}
+		}
+	}
+	return v.data[start:]
+}
+
+// container checks the struct, list or map opened at v.i.
+func (v *validator) container(open byte) error {
+	if v.depth++; v.depth > maxDepth {
+		return v.s.syntaxError(v.data[v.i:], "exceeded max nesting depth", "")
+	}
+	close := closing(open)
+	v.i++
+	for {
+		v.skipSpace()
+		var err error
+		if open == '<' {
+			err = v.entry()
+		} else {
+			err = v.value()
+		}
+		if err != nil {
+			return err
+		}
+		v.skipSpace()
+
+		if v.i == len(v.data) {
+			return v.s.syntaxError(v.data[v.i:], "unexpected end of input", string(close))
+		}
+		switch c := v.data[v.i]; c {
+		case ',':
+			v.i++
+		case close:
+			v.i++
+			v.depth--
+			return nil
+		case '}', ']', '>':
+			return v.s.syntaxError(v.data[v.i:], "unexpected "+strconv.QuoteRune(rune(c)), string(close))
+		default:
+			return v.s.syntaxError(v.data[v.i:], "unexpected "+strconv.QuoteRune(rune(c))+" after value", ",")
+		}
+	}
+}
+
+// entry checks the key:value map entry at v.i, which may be empty.
+func (v *validator) entry() error {
+	if v.i == len(v.data) {
+		return nil
+	}
+	start := v.i
+	switch c := v.data[v.i]; {
+	case c == ',' || c == '>':
+		return nil
+	case c == '"':
+		if err := v.str(); err != nil {
+			return err
+		}
+	default:
+		if key := v.scalar(); !isNumber(key) {
+			return v.s.syntaxError(v.data[start:], "invalid map key", "string or number")
+		}
+	}
+	v.skipSpace()
+	if v.i == len(v.data) || v.data[v.i] != ':' {
+		return v.s.syntaxError(v.data[start:], "map entry without key", ":")
+	}
+	v.i++
+	v.skipSpace()
+	return v.value()
+}
+
+// str checks the string starting at v.i: it must be closed on the same
+// line and every escape sequence in it must be known.
+func (v *validator) str() error {
+	start := v.i
+	for i := start + 1; i < len(v.data); i++ {
+		switch v.data[i] {
+		case '\\':
+			n := escapeLen(v.data[i:])
+			if n == 0 && i+1 < len(v.data) && v.data[i+1] != '\n' {
+				return v.s.syntaxError(v.data[i:], "invalid escape sequence", escapeSequences)
+			}
+			if n == 0 {
+				return v.s.syntaxError(v.data[start:], "unterminated string", `"`)
+			}
+			i += n - 1
+		case '"':
+			v.i = i + 1
+			return nil
+		case '\n':
+			return v.s.syntaxError(v.data[start:], "unterminated string", `"`)
+		}
+	}
+	return v.s.syntaxError(v.data[start:], "unterminated string", `"`)
+}
+
+// bytes checks the b"base64" token at v.i.
+func (v *validator) bytes() error {
+	start := v.i
+	end := start + stringEnd(v.data[start+1:]) + 1
+	if v.data[end-1] != '"' || end == start+2 {
+		return v.s.syntaxError(v.data[start:], "unterminated string", `"`)
+	}
+	if !isBase64(v.data[start+2 : end-1]) {
+		return v.s.syntaxError(v.data[start+2:], "invalid base64 data", "base64")
+	}
+	v.i = end
+	return nil
+}
+
+// tag checks the @name:value token at v.i.
+func (v *validator) tag() error {
+	start := v.i
+	i := start + 1
+	for i < len(v.data) && isTypeNameByte(v.data[i]) {
+		i++
+	}
+	if i == start+1 || i == len(v.data) || v.data[i] != ':' {
+		return v.s.syntaxError(v.data[start:], "malformed type tag", "@name:")
+	}
+	if v.depth++; v.depth > maxDepth {
+		return v.s.syntaxError(v.data[start:], "exceeded max nesting depth", "")
+	}
+	v.i = i + 1
+	v.skipSpace()
+	if err := v.value(); err != nil {
+		return err
+	}
+	v.depth--
+	return nil
+}
+
+// isBase64 reports whether b is padded standard base64.
+func isBase64(b []byte) bool {
+	if len(b)%4 != 0 {
+		return false
+	}
+	for i, c := range b {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '+', c == '/':
+		case c == '=' && i >= len(b)-2:
+			if i == len(b)-2 && b[i+1] != '=' {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package ido
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var validTests = []struct {
+	in     string
+	offset int64 // of the *SyntaxError; -1 if valid
+}{
+	{``, -1},
+	{`  // only a comment`, -1},
+	{`{"John",,30}`, -1},
+	{`{,}`, -1},
+	{`[1, -2.5e-3, NaN, Inf, -Inf, +, -, ~]`, -1},
+	{`<"a":1,2:[],"c":>`, -1},
+	{`<>`, -1},
+	{`{b"aGk=",b""}`, -1},
+	{`@test.circle:{1}`, -1},
+	{`@a:@b:`, -1},
+	{"{\n  1, // one\n  \"x\" // x\n}", -1},
+	{`"\"\\\n\r\té😀"`, -1},
+
+	{`{1 2}`, 3},
+	{`[a b]`, 1},
+	{`{"a" "b"}`, 5},
+	{`{1]`, 2},
+	{`{1,2`, 4},
+	{`}`, 0},
+	{`,`, 0},
+	{`{1} 2`, 4},
+	{`"abc`, 0},
+	{"[\"ab\ncd\"]", 1},
+	{`"a\qb"`, 2},
+	{`"\u12"`, 1},
+	{`+5`, 0},
+	{`0x10`, 0},
+	{`nan`, 0},
+	{`{true}`, 1},
+	{`b"a"`, 2},
+	{`b"abc`, 0},
+	{`@:1`, 0},
+	{`@bad name:1`, 0},
+	{`<1>`, 1},
+	{`<:>`, 1},
+	{`<+:1>`, 1},
+	{`{[<:>]}`, 3},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validTests {
+		err := Validate([]byte(tt.in))
+		if tt.offset < 0 {
+			if err != nil {
+				t.Errorf("Validate(%q) = %v, want nil", tt.in, err)
+			}
+			if !Valid([]byte(tt.in)) {
+				t.Errorf("Valid(%q) = false, want true", tt.in)
+			}
+			continue
+		}
+		var serr *SyntaxError
+		if !errors.As(err, &serr) || serr.Offset != tt.offset {
+			t.Errorf("Validate(%q) = %v, want *SyntaxError at offset %d", tt.in, err, tt.offset)
+		}
+		if Valid([]byte(tt.in)) {
+			t.Errorf("Valid(%q) = true, want false", tt.in)
+		}
+	}
+}
+
+// Valid and Unmarshal into an empty interface must agree on every input.
+func TestValidAgreesWithUnmarshal(t *testing.T) {
+	for _, tt := range validTests {
+		var v any
+		valid := Valid([]byte(tt.in))
+		err := Unmarshal([]byte(tt.in), &v)
+		if valid != (err == nil) {
+			t.Errorf("Valid(%q) = %v, but Unmarshal returned %v", tt.in, valid, err)
+		}
+	}
+}
+
+func TestValidateDepth(t *testing.T) {
+	nested := func(n int) []byte {
+		return []byte(strings.Repeat("[", n) + strings.Repeat("]", n))
+	}
+	if err := Validate(nested(maxDepth)); err != nil {
+		t.Errorf("Validate(depth %d) = %v, want nil", maxDepth, err)
+	}
+
+	var serr *SyntaxError
+	if err := Validate(nested(maxDepth + 1)); !errors.As(err, &serr) || serr.Offset != maxDepth {
+		t.Errorf("Validate(depth %d) = %v, want *SyntaxError at offset %d", maxDepth+1, err, maxDepth)
+	}
+	var v any
+	if err := Unmarshal(nested(maxDepth+1), &v); !errors.As(err, &serr) || serr.Offset != maxDepth {
+		t.Errorf("Unmarshal(depth %d) = %v, want *SyntaxError at offset %d", maxDepth+1, err, maxDepth)
+	}
+
+	// Hostile input is rejected at the depth limit, not after a scan that
+	// grows with its whole size.
+	if err := Validate(nested(1 << 20)); err == nil {
+		t.Errorf("Validate(depth %d) = nil, want error", 1<<20)
+	}
+	tag := []byte(strings.Repeat("@a:", maxDepth+1) + "1")
+	if err := Validate(tag); err == nil {
+		t.Errorf("Validate(%d nested type tags) = nil, want error", maxDepth+1)
+	}
+}
+
+func TestDecoderValidate(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("{1,2}\n\n{1 2}\n[3]\n"))
+	if err := dec.Validate(); err != nil {
+		t.Errorf("Validate record 1 = %v, want nil", err)
+	}
+	var serr *SyntaxError
+	if err := dec.Validate(); !errors.As(err, &serr) || serr.Offset != 10 {
+		t.Errorf("Validate record 2 = %v, want *SyntaxError at stream offset 10", err)
+	}
+	if err := dec.Validate(); err != nil {
+		t.Errorf("Validate record 3 = %v, want nil", err)
+	}
+}
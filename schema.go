@@ -0,0 +1,405 @@
+package ido
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------
+// SCHEMA
+// ---------------------------------------------------------
+
+// Schema describes the wire layout of a Go type: every struct field that
+// is encoded, with its name, slot positions and kind. Encoder writes it as
+// a header record so files can be understood and checked without the Go
+// type that wrote them.
+type Schema struct {
+	Type     string        // Go type of the records, e.g. "main.Person"
+	Kind     string        // kind of the records, as in SchemaField.Kind
+	Fields   []SchemaField // nested fields follow the field that holds them
+	Reserved [][]int       // Index of every slot kept by ido:",deprecated"
+}
+
+// SchemaField describes one encoded struct field.
+type SchemaField struct {
+	// Path names the field from the root, e.g. "Bank.Location". Elements
+	// of slices and arrays add "[]" and map values "<>", as in
+	// "Members[].Age". Names come from the name= tag option when set.
+	Path string
+
+	// Index holds the slot position of the field and of every struct
+	// field that encloses it.
+	Index []int
+
+	// Kind is the Go kind of the field's values with pointers removed:
+	// "string", "int64", "struct", "[]string", "map[string]int", and
+	// "time", "duration", "number", "any", "marshaler", "text" or "json"
+	// for values with their own encoding.
+	Kind string
+}
+
+// SchemaOf returns the schema of t, built from the same field layout the
+// encoder uses. It panics if t has an invalid ido tag, which Marshal
+// reports as an error.
+func SchemaOf(t reflect.Type) Schema {
+	s, err := schemaOf(t)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Fingerprint returns a hash of the wire layout described by s: the kind of
+// its records and the slot positions and kinds of its fields. Names are
+// left out, so renaming a field keeps the fingerprint while reordering or
+// retyping one changes it.
+func (s Schema) Fingerprint() uint64 {
+	h := fnv.New64a()
+	buf := append([]byte(s.Kind), 0)
+	h.Write(buf)
+	for _, f := range s.Fields {
+		buf = buf[:0]
+		for _, i := range f.Index {
+			buf = strconv.AppendInt(buf, int64(i), 10)
+			buf = append(buf, '.')
+		}
+		buf = append(buf, f.Kind...)
+		buf = append(buf, 0)
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+// schemaOf returns the schema of t.
+func schemaOf(t reflect.Type) (Schema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	s := Schema{Type: t.String(), Kind: schemaKind(t)}
+	err := s.walk(t, "", nil, map[reflect.Type]bool{})
+	return s, err
+}
+
+// walk appends the fields reachable from values of type t. seen holds the
+// struct types being walked, so recursive types stop at their first
+// repetition.
+func (s *Schema) walk(t reflect.Type, path string, index []int, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if customEncoding(t) || isTextType(t, textMarshalerType) || isTextType(t, textUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return s.walk(t.Elem(), path+"[]", index, seen)
+	case reflect.Map:
+		return s.walk(t.Elem(), path+"<>", index, seen)
+	case reflect.Struct:
+		if t == timeType || seen[t] {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	slots, err := structFields(t)
+	if err != nil {
+		return err
+	}
+	seen[t] = true
+	for pos, f := range slots {
+		idx := append(index[:len(index):len(index)], pos)
+		if f.deprecated {
+			s.Reserved = append(s.Reserved, idx)
+		}
+		if f.index == nil {
+			continue
+		}
+		ft := t.FieldByIndex(f.index).Type
+		p := f.label
+		if path != "" {
+			p = path + "." + f.label
+		}
+		if f.json {
+			s.Fields = append(s.Fields, SchemaField{Path: p, Index: idx, Kind: "json"})
+			continue
+		}
+		s.Fields = append(s.Fields, SchemaField{Path: p, Index: idx, Kind: schemaKind(ft)})
+		if err := s.walk(ft, p, idx, seen); err != nil {
+			return err
+		}
+	}
+	delete(seen, t)
+	return nil
+}
+
+// customEncoding reports whether values of t are written by something
+// other than the reflection encoders.
+func customEncoding(t reflect.Type) bool {
+	return t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) ||
+		t.Implements(unmarshalerType) || reflect.PointerTo(t).Implements(unmarshalerType)
+}
+
+// schemaKind returns the Kind of SchemaField for values of type t.
+func schemaKind(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case customEncoding(t):
+		return "marshaler"
+	case isTextType(t, textMarshalerType) || isTextType(t, textUnmarshalerType):
+		return "text"
+	case t == timeType:
+		return "time"
+	case t == durationType:
+		return "duration"
+	case t == numberType:
+		return "number"
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		return "[]" + schemaKind(t.Elem())
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + schemaKind(t.Elem())
+	case reflect.Map:
+		return "map[" + schemaKind(t.Key()) + "]" + schemaKind(t.Elem())
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+// ChangeKind classifies a SchemaChange.
+type ChangeKind uint8
+
+const (
+	FieldAdded   ChangeKind = iota + 1 // field only in the new schema
+	FieldRemoved                       // field only in the old schema
+	FieldRetyped                       // field whose kind changed
+	FieldMoved                         // field whose slot position changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case FieldAdded:
+		return "added"
+	case FieldRemoved:
+		return "removed"
+	case FieldRetyped:
+		return "retyped"
+	case FieldMoved:
+		return "moved"
+	}
+	return "ChangeKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A SchemaChange describes how one field differs between two schemas.
+type SchemaChange struct {
+	Kind     ChangeKind
+	Path     string      // empty for the records themselves
+	Old, New SchemaField // the field in each schema; zero when absent
+	Breaking bool        // data written with the old schema decodes wrongly
+}
+
+func (c SchemaChange) String() string {
+	path := c.Path
+	if path == "" {
+		path = "record"
+	}
+	switch c.Kind {
+	case FieldRetyped:
+		return path + " retyped from " + c.Old.Kind + " to " + c.New.Kind
+	case FieldMoved:
+		return path + " moved from " + fmt.Sprint(c.Old.Index) + " to " + fmt.Sprint(c.New.Index)
+	}
+	return path + " " + c.Kind.String()
+}
+
+// A SchemaError reports breaking changes between the schema data was
+// written with and the schema it is read with.
+type SchemaError struct {
+	Type    string         // Go type of the schema data is read with
+	Changes []SchemaChange // the breaking changes, in field order
+}
+
+func (e *SchemaError) Error() string {
+	s := "ido: schema of " + e.Type + " is incompatible with the data: " + e.Changes[0].String()
+	if n := len(e.Changes) - 1; n > 0 {
+		s += " (and " + strconv.Itoa(n) + " more)"
+	}
+	return s
+}
+
+// CheckCompatible compares the schema data was written with, old, to the
+// schema it will be read with, new. Fields are matched by path. It returns
+// every added, removed, retyped and moved field; if any of those changes
+// breaks the old data, the error is a *SchemaError listing them. Records of
+// another kind are reported as a single retyped change with an empty Path,
+// which breaks the old data unless new only swaps parts of the kind for
+// "any": []int64 data decodes into []any but not into []time.Time.
+//
+// Fields appended after the last slot of their struct do not break old
+// data, which just lacks them, and neither do removed fields whose slot new
+// keeps reserved with ido:",deprecated". Every other change does. Changes
+// inside an added or removed field are not listed separately.
+func CheckCompatible(old, new Schema) ([]SchemaChange, error) {
+	if old.Kind != new.Kind {
+		c := SchemaChange{Kind: FieldRetyped, Old: SchemaField{Kind: old.Kind}, New: SchemaField{Kind: new.Kind}}
+		if !kindAccepts(new.Kind, old.Kind) {
+			c.Breaking = true
+			return []SchemaChange{c}, &SchemaError{Type: new.Type, Changes: []SchemaChange{c}}
+		}
+		return []SchemaChange{c}, nil
+	}
+
+	oldFields := make(map[string]SchemaField, len(old.Fields))
+	for _, f := range old.Fields {
+		oldFields[f.Path] = f
+	}
+	newFields := make(map[string]SchemaField, len(new.Fields))
+	for _, f := range new.Fields {
+		newFields[f.Path] = f
+	}
+
+	var changes []SchemaChange
+	var breaking []SchemaChange
+	add := func(c SchemaChange) {
+		changes = append(changes, c)
+		if c.Breaking {
+			breaking = append(breaking, c)
+		}
+	}
+
+	skip := ""
+	for _, o := range old.Fields {
+		if skip != "" && isSubpath(o.Path, skip) {
+			continue
+		}
+		n, ok := newFields[o.Path]
+		if !ok {
+			add(SchemaChange{Kind: FieldRemoved, Path: o.Path, Old: o, Breaking: !containsIndex(new.Reserved, o.Index)})
+			skip = o.Path
+			continue
+		}
+		if o.Kind != n.Kind {
+			add(SchemaChange{Kind: FieldRetyped, Path: o.Path, Old: o, New: n, Breaking: true})
+		}
+		if !slices.Equal(o.Index, n.Index) {
+			add(SchemaChange{Kind: FieldMoved, Path: o.Path, Old: o, New: n, Breaking: true})
+		}
+	}
+
+	skip = ""
+	for _, n := range new.Fields {
+		if skip != "" && isSubpath(n.Path, skip) {
+			continue
+		}
+		if _, ok := oldFields[n.Path]; !ok {
+			add(SchemaChange{Kind: FieldAdded, Path: n.Path, New: n, Breaking: !appended(old, n.Index)})
+			skip = n.Path
+		}
+	}
+
+	if len(breaking) > 0 {
+		return changes, &SchemaError{Type: new.Type, Changes: breaking}
+	}
+	return changes, nil
+}
+
+// kindAccepts reports whether values written with kind old decode into
+// values of kind new: the kinds are equal, or new has "any" where old has
+// some other kind.
+func kindAccepts(new, old string) bool {
+	if new == old || new == "any" {
+		return true
+	}
+	if strings.HasPrefix(new, "map[") && strings.HasPrefix(old, "map[") {
+		nk, nv := splitMapKind(new)
+		ok, ov := splitMapKind(old)
+		return kindAccepts(nk, ok) && kindAccepts(nv, ov)
+	}
+	if strings.HasPrefix(new, "[") && strings.HasPrefix(old, "[") {
+		i := strings.IndexByte(new, ']')
+		return new[:i] == old[:min(i, len(old))] && i < len(old) && old[i] == ']' &&
+			kindAccepts(new[i+1:], old[i+1:])
+	}
+	return false
+}
+
+// splitMapKind splits "map[K]V" into K and V.
+func splitMapKind(kind string) (key, elem string) {
+	depth := 0
+	for i := len("map["); i < len(kind); i++ {
+		switch kind[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth == 0 {
+				return kind[len("map["):i], kind[i+1:]
+			}
+			depth--
+		}
+	}
+	return kind, ""
+}
+
+// isSubpath reports whether path names a field inside the field parent.
+func isSubpath(path, parent string) bool {
+	if len(path) <= len(parent) || path[:len(parent)] != parent {
+		return false
+	}
+	switch path[len(parent)] {
+	case '.', '[', '<':
+		return true
+	}
+	return false
+}
+
+func containsIndex(list [][]int, index []int) bool {
+	for _, i := range list {
+		if slices.Equal(i, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// appended reports whether index lies after every slot that s uses in the
+// same struct, so that data written with s has no value there.
+func appended(s Schema, index []int) bool {
+	parent, pos := index[:len(index)-1], index[len(index)-1]
+	after := func(i []int) bool {
+		return len(i) != len(index) || !slices.Equal(i[:len(parent)], parent) || i[len(parent)] < pos
+	}
+	for _, f := range s.Fields {
+		if !after(f.Index) {
+			return false
+		}
+	}
+	for _, r := range s.Reserved {
+		if !after(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSchema checks that records written with the schema header of a
+// stream can be decoded into t. Type names are not compared, so moving or
+// renaming a type does not invalidate its files.
+func checkSchema(header Schema, t reflect.Type) error {
+	want, err := schemaOf(t)
+	if err != nil {
+		return err
+	}
+	_, err = CheckCompatible(header, want)
+	return err
+}
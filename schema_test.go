@@ -0,0 +1,276 @@
+package ido
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type headerV1 struct {
+	Name string
+	Age  int
+}
+
+type headerV2 struct {
+	Age  int
+	Name string
+}
+
+func TestSchemaHeader(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetSchemaHeader(true)
+	for _, v := range []any{headerV1{"a", 1}, headerV1{"b", 2}, []int64{3}, headerV1{"c", 4}} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatalf("Encode(%v): %v", v, err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		`#{"ido.headerV1","struct",[{"Name",[0],"string"},{"Age",[1],"int"}],}`,
+		`{"a",1}`,
+		`{"b",2}`,
+		`#{"[]int64","[]int64",,}`,
+		`[3]`,
+		`#{"ido.headerV1","struct",[{"Name",[0],"string"},{"Age",[1],"int"}],}`,
+		`{"c",4}`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("stream =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	dec := NewDecoder(strings.NewReader(buf.String()))
+	var v headerV1
+	if err := dec.Decode(&v); err != nil || v != (headerV1{"a", 1}) {
+		t.Fatalf("Decode = %+v, %v", v, err)
+	}
+	if s := dec.Schema(); s == nil || !reflect.DeepEqual(*s, SchemaOf(reflect.TypeOf(v))) {
+		t.Errorf("Schema = %+v, want %+v", s, SchemaOf(reflect.TypeOf(v)))
+	}
+	if err := dec.Decode(&v); err != nil || v != (headerV1{"b", 2}) {
+		t.Fatalf("Decode = %+v, %v", v, err)
+	}
+	var list []int64
+	if err := dec.Decode(&list); err != nil || !reflect.DeepEqual(list, []int64{3}) {
+		t.Fatalf("Decode = %v, %v", list, err)
+	}
+	if s := dec.Schema(); s == nil || s.Kind != "[]int64" {
+		t.Errorf("Schema after type change = %+v, want kind []int64", s)
+	}
+}
+
+func TestSchemaHeaderMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetSchemaHeader(true)
+	if err := enc.Encode(headerV1{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode([]int64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.String()
+
+	tests := []struct {
+		skip   int // records to read first
+		target any
+		ok     bool
+	}{
+		{0, new(headerV1), true},
+		{0, new(headerV2), false}, // fields moved
+		{0, new([]int), false},    // another record kind
+		{0, new(any), true},       // generic targets are not checked
+		{1, new([]int64), true},
+		{1, new([]any), true},
+		{1, new([]time.Time), false},
+		{1, new(headerV1), false},
+	}
+	for _, tt := range tests {
+		dec := NewDecoder(strings.NewReader(stream))
+		for i := 0; i < tt.skip; i++ {
+			var skip any
+			if err := dec.Decode(&skip); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := dec.Decode(tt.target)
+		var serr *SchemaError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("record %d into %T: %v", tt.skip, tt.target, err)
+		case !tt.ok && !errors.As(err, &serr):
+			t.Errorf("record %d into %T = %v, want *SchemaError", tt.skip, tt.target, err)
+		}
+	}
+
+	// A header for non-struct records is checked too.
+	dec := NewDecoder(strings.NewReader("#{\"[]int\",\"[]int\",,}\n[1]\n"))
+	var v headerV1
+	var serr *SchemaError
+	if err := dec.Decode(&v); !errors.As(err, &serr) || serr.Changes[0].Path != "" {
+		t.Errorf("Decode([]int record into struct) = %v, want *SchemaError for the record", err)
+	}
+}
+
+type schemaItem struct{ X int }
+
+type schemaBase struct {
+	A int
+	B string
+	C []schemaItem
+}
+
+func schemaFor(v any) Schema { return SchemaOf(reflect.TypeOf(v)) }
+
+func TestCheckCompatible(t *testing.T) {
+	type change struct {
+		kind     ChangeKind
+		path     string
+		breaking bool
+	}
+	base := schemaFor(schemaBase{})
+
+	tests := []struct {
+		name string
+		new  Schema
+		want []change
+	}{
+		{"unchanged", base, nil},
+		{"appended field", schemaFor(struct {
+			A int
+			B string
+			C []schemaItem
+			D bool
+		}{}), []change{{FieldAdded, "D", false}}},
+		{"appended nested field", schemaFor(struct {
+			A int
+			B string
+			C []struct{ X, Y int }
+		}{}), []change{{FieldAdded, "C[].Y", false}}},
+		{"inserted field", schemaFor(struct {
+			A int
+			D bool
+			B string
+			C []schemaItem
+		}{}), []change{
+			{FieldMoved, "B", true},
+			{FieldMoved, "C", true},
+			{FieldMoved, "C[].X", true},
+			{FieldAdded, "D", true},
+		}},
+		{"removed and reserved", schemaFor(struct {
+			A int
+			_ struct{} `ido:",deprecated"`
+			C []schemaItem
+		}{}), []change{{FieldRemoved, "B", false}}},
+		{"removed", schemaFor(struct {
+			A int
+			B string
+		}{}), []change{{FieldRemoved, "C", true}}},
+		{"retyped", schemaFor(struct {
+			A string
+			B string
+			C []schemaItem
+		}{}), []change{{FieldRetyped, "A", true}}},
+		{"moved by tag", schemaFor(struct {
+			A int          `ido:"1"`
+			B string       `ido:"0"`
+			C []schemaItem `ido:"2"`
+		}{}), []change{{FieldMoved, "A", true}, {FieldMoved, "B", true}}},
+		{"renamed", schemaFor(struct {
+			A    int
+			Name string
+			C    []schemaItem
+		}{}), []change{{FieldRemoved, "B", true}, {FieldAdded, "Name", true}}},
+		{"renamed keeping name=", schemaFor(struct {
+			A    int
+			Name string `ido:"name=B"`
+			C    []schemaItem
+		}{}), nil},
+		{"another record kind", schemaFor([]schemaBase{}), []change{{FieldRetyped, "", true}}},
+	}
+
+	for _, tt := range tests {
+		changes, err := CheckCompatible(base, tt.new)
+		var got []change
+		for _, c := range changes {
+			got = append(got, change{c.Kind, c.Path, c.Breaking})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changes = %v, want %v", tt.name, got, tt.want)
+		}
+
+		var breaking []SchemaChange
+		for _, c := range changes {
+			if c.Breaking {
+				breaking = append(breaking, c)
+			}
+		}
+		var serr *SchemaError
+		switch {
+		case breaking == nil && err != nil:
+			t.Errorf("%s: err = %v, want nil", tt.name, err)
+		case breaking != nil && (!errors.As(err, &serr) || !reflect.DeepEqual(serr.Changes, breaking)):
+			t.Errorf("%s: err = %v, want *SchemaError with the breaking changes", tt.name, err)
+		}
+	}
+}
+
+func TestCheckCompatibleAny(t *testing.T) {
+	old := schemaFor(map[string][]int64{})
+	for _, tt := range []struct {
+		new any
+		ok  bool
+	}{
+		{map[string][]int64{}, true},
+		{map[string]any{}, true},
+		{map[string][]any{}, true},
+		{map[string][]time.Time{}, false},
+		{[]int64{}, false},
+	} {
+		_, err := CheckCompatible(old, schemaFor(tt.new))
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckCompatible(%s, %T) = %v, want ok %v", old.Kind, tt.new, err, tt.ok)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := schemaFor(schemaBase{}).Fingerprint()
+	for _, tt := range []struct {
+		name string
+		v    any
+		same bool
+	}{
+		{"renamed fields", struct {
+			First  int
+			Second string
+			Third  []struct{ Y int }
+		}{}, true},
+		{"retyped field", struct {
+			A int64
+			B string
+			C []schemaItem
+		}{}, false},
+		{"reordered fields", struct {
+			B string
+			A int
+			C []schemaItem
+		}{}, false},
+		{"appended field", struct {
+			A int
+			B string
+			C []schemaItem
+			D int
+		}{}, false},
+		{"another record kind", []schemaBase{}, false},
+	} {
+		if got := schemaFor(tt.v).Fingerprint(); (got == base) != tt.same {
+			t.Errorf("%s: fingerprint %x vs %x, want same %v", tt.name, got, base, tt.same)
+		}
+	}
+}